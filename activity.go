@@ -32,6 +32,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/benjojo/honk-benjojo/image"
 	"github.com/ridge/must/v2"
 	"github.com/ridge/tj"
 	"humungus.tedunangst.com/r/webs/cache"
@@ -124,12 +125,18 @@ func PostMsg(keyname string, key httpsig.PrivateKey, url string, msg []byte) err
 
 // -- junk
 func getAndParseLongTimeout(userid int64, url string) (junk.Junk, error) {
-	return getAndParseWithTimeout(userid, url, slowTimeout*time.Second)
+	return getAndParseWithTimeout(userid, url, slowTimeout*time.Second, false)
 }
 
 // -- junk
 func getAndParseShortTimeout(userid int64, url string) (junk.Junk, error) {
-	return getAndParseWithTimeout(userid, url, fastTimeout*time.Second)
+	return getAndParseWithTimeout(userid, url, fastTimeout*time.Second, false)
+}
+
+// getAndParseKey fetches the owner of a public key.
+// Hosts missing from the allowlist are asked too, so they can sign.
+func getAndParseKey(keyname string) (junk.Junk, error) {
+	return getAndParseWithTimeout(serverUID, keyname, slowTimeout*time.Second, true)
 }
 
 // -- junk
@@ -157,8 +164,13 @@ var flightdeck = gate.NewSerializer()
 var signGets = true
 
 // -- junk ziggies
-func getAndParse(userid int64, url string, accept string, agent string, timeout time.Duration, client *http.Client) (junk.Junk, error) {
+func getAndParse(userid int64, url string, accept string, agent string, timeout time.Duration, client *http.Client, forkey bool) (junk.Junk, error) {
 	log.Printf("Outbound (getAndParse) Request: %v", url)
+	if forkey && policyUnlists(url) {
+		dlog.Printf("fetching key from unlisted %s", url)
+	} else if policyHoldsBack(url, "fetch") {
+		return nil, fmt.Errorf("fetch refused by domain policy: %s", url)
+	}
 	if client == nil {
 		client = http.DefaultClient
 	}
@@ -195,11 +207,15 @@ func getAndParse(userid int64, url string, accept string, agent string, timeout
 		io.ReadFull(resp.Body, errorSample)
 		return nil, fmt.Errorf("http get status: %d [%s]", resp.StatusCode, errorSample)
 	}
-	return junk.Read(resp.Body)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parsejunk(data)
 }
 
 // -- junk
-func getAndParseWithTimeout(userid int64, url string, timeout time.Duration) (junk.Junk, error) {
+func getAndParseWithTimeout(userid int64, url string, timeout time.Duration, forkey bool) (junk.Junk, error) {
 	log.Printf("Outbound (getAndParseWithTimeout) Request: %v", url)
 	client := http.DefaultClient
 	if develMode {
@@ -210,7 +226,7 @@ func getAndParseWithTimeout(userid int64, url string, timeout time.Duration) (ju
 		if strings.Contains(url, ".well-known/webfinger?resource") {
 			at = "application/jrd+json"
 		}
-		j, err := getAndParse(userid, url, at, "honksnonk/5.0; "+serverName, timeout, client)
+		j, err := getAndParse(userid, url, at, "honksnonk/5.0; "+serverName, timeout, client, forkey)
 		// log.Printf("debug junk %#v", j)
 		if err != nil {
 			log.Printf("Outbound (getAndParseWithTimeout) Request: %v Failed! %v", url, err)
@@ -224,6 +240,9 @@ func getAndParseWithTimeout(userid int64, url string, timeout time.Duration) (ju
 	return j, nil
 }
 
+// fetchsome quietly stops reading here
+const fetchLimit = 10 * 1024 * 1024
+
 func fetchsome(url string) ([]byte, error) {
 	log.Printf("Outbound (fetchsome) Request: %v", url)
 	client := http.DefaultClient
@@ -253,12 +272,12 @@ func fetchsome(url string) ([]byte, error) {
 		return nil, fmt.Errorf("http get not 200: %d %s", resp.StatusCode, url)
 	}
 	var buf bytes.Buffer
-	limiter := io.LimitReader(resp.Body, 10*1024*1024)
+	limiter := io.LimitReader(resp.Body, fetchLimit)
 	io.Copy(&buf, limiter)
 	return buf.Bytes(), nil
 }
 
-func saveAttachment(url string, name, desc, media string, localize bool) *Attachment {
+func saveAttachment(url string, name, desc, media string, info *MediaInfo, localize bool) *Attachment {
 	if url == "" {
 		return nil
 	}
@@ -266,7 +285,12 @@ func saveAttachment(url string, name, desc, media string, localize bool) *Attach
 		return attachment
 	}
 	ilog.Printf("saving attachment: %s", url)
+	if localize && policyStripsMedia(url) {
+		dlog.Printf("not localizing attachment per domain policy: %s", url)
+		localize = false
+	}
 	data := []byte{}
+	var sized map[string]*image.Image
 	if localize {
 		ii, err := flightdeck.Call(url, func() (interface{}, error) {
 			return fetchsome(url)
@@ -278,11 +302,12 @@ func saveAttachment(url string, name, desc, media string, localize bool) *Attach
 		}
 		data = ii.([]byte)
 
-		if len(data) == 10*1024*1024 {
+		if len(data) == fetchLimit {
 			ilog.Printf("truncation likely")
 		}
 		if strings.HasPrefix(media, "image") {
-			img, err := shrinkit(data)
+			var img *image.Image
+			img, sized, err = shrinkwithrenditions(data)
 			if err != nil {
 				ilog.Printf("unable to decode image: %s", err)
 				localize = false
@@ -291,6 +316,7 @@ func saveAttachment(url string, name, desc, media string, localize bool) *Attach
 			}
 			data = img.Data
 			media = "image/" + img.Format
+			info = &MediaInfo{Width: img.Width, Height: img.Height, Blurhash: img.Blurhash}
 		} else if media == "application/pdf" {
 			if len(data) > 1000000 {
 				ilog.Printf("not saving large pdf")
@@ -302,8 +328,23 @@ func saveAttachment(url string, name, desc, media string, localize bool) *Attach
 			localize = false
 			data = []byte{}
 		}
+		if localize && !strings.HasPrefix(media, "image") {
+			// don't serve something else under their label
+			probed, err := probeit(data)
+			if err != nil {
+				ilog.Printf("not saving attachment %s: %s", url, err)
+				localize = false
+				data = []byte{}
+			} else if !strings.HasPrefix(media, probed.Media) {
+				ilog.Printf("attachment %s is %s, not %s", url, probed.Media, media)
+				localize = false
+				data = []byte{}
+			}
+		}
 	}
 saveit:
+	fileLock.RLock()
+	defer fileLock.RUnlock()
 	var xid string
 	if localize {
 		var err error
@@ -312,8 +353,9 @@ saveit:
 			elog.Printf("error saving file %s body: %s", url, err)
 			return nil
 		}
+		saveRenditions(xid, sized)
 	}
-	fileID, err := saveFileMetadata(xid, name, desc, url, media)
+	fileID, err := saveFileMetadata(xid, name, desc, url, media, info)
 	if err != nil {
 		elog.Printf("error saving file %s: %s", url, err)
 		return nil
@@ -391,6 +433,7 @@ func saveActivityPubActivity(x *ActivityPubActivity) {
 	go handles(x.Author)
 	go handles(x.Oonker)
 	savehonk(x)
+	countseen(x)
 }
 
 type Box struct {
@@ -738,6 +781,13 @@ func xonksaver(user *UserProfile, item junk.Junk, origin string) *ActivityPubAct
 				dt = dt2
 			}
 			content, _ := obj.GetString("content")
+			if cmap, ok := obj.GetMap("contentMap"); ok {
+				for lang, c := range cmap {
+					if xonk.Lang == "" || c == content {
+						xonk.Lang = strings.ToLower(lang)
+					}
+				}
+			}
 			if !strings.HasPrefix(content, "<p>") {
 				content = "<p>" + content
 			}
@@ -798,9 +848,10 @@ func xonksaver(user *UserProfile, item junk.Junk, origin string) *ActivityPubAct
 				content = content[:90001]
 			}
 
-			xonk.Text = content
-			xonk.Precis = precis
-			if rejectxonk(&xonk) {
+			cleaned := sanitizehtml(xid, content, precis)
+			xonk.Text = cleaned[0]
+			xonk.Precis = cleaned[1]
+			if fastrejectxonk(&xonk) {
 				dlog.Printf("fast reject: %s", xid)
 				return nil
 			}
@@ -834,6 +885,12 @@ func xonksaver(user *UserProfile, item junk.Junk, origin string) *ActivityPubAct
 				if desc == "" {
 					desc = name
 				}
+				blurhash, _ := att.GetString("blurhash")
+				if len(blurhash) > 100 {
+					blurhash = ""
+				}
+				width, _ := att.GetNumber("width")
+				height, _ := att.GetNumber("height")
 				localize := false
 				if numatts > 4 {
 					ilog.Printf("excessive attachment: %s", at)
@@ -847,10 +904,11 @@ func xonksaver(user *UserProfile, item junk.Junk, origin string) *ActivityPubAct
 				} else {
 					ilog.Printf("unknown attachment: %s", at)
 				}
-				if skipMedia(&xonk) {
+				if skipMedia(&xonk) || policyStripsMedia(xonk.XID) {
 					localize = false
 				}
-				attachment := saveAttachment(u, name, desc, mt, localize)
+				info := &MediaInfo{Width: int(width), Height: int(height), Blurhash: blurhash}
+				attachment := saveAttachment(u, name, desc, mt, info, localize)
 				if attachment != nil {
 					xonk.Attachments = append(xonk.Attachments, attachment)
 				}
@@ -888,7 +946,7 @@ func xonksaver(user *UserProfile, item junk.Junk, origin string) *ActivityPubAct
 						mt = "image/png"
 					}
 					u, _ := icon.GetString("url")
-					attachment := saveAttachment(u, name, desc, mt, true)
+					attachment := saveAttachment(u, name, desc, mt, nil, true)
 					if attachment != nil {
 						xonk.Attachments = append(xonk.Attachments, attachment)
 					}
@@ -1116,13 +1174,24 @@ func activateAttachments(attachments []*Attachment) []tj.O {
 		if re_emus.MatchString(d.Name) {
 			continue
 		}
-		atts = append(atts, tj.O{
+		att := tj.O{
 			"mediaType": d.Media,
 			"name":      d.Name,
 			"summary":   html.EscapeString(d.Desc),
 			"type":      "Document",
 			"url":       d.URL,
-		})
+		}
+		if d.Blurhash != "" {
+			att["blurhash"] = d.Blurhash
+		}
+		if d.Width > 0 && d.Height > 0 {
+			att["width"] = d.Width
+			att["height"] = d.Height
+		}
+		if d.Duration > 0 {
+			att["duration"] = "PT" + strings.ToUpper(d.Duration.String())
+		}
+		atts = append(atts, att)
 	}
 	return atts
 }
@@ -1322,7 +1391,7 @@ var oldjonks = cache.New(cache.Options{Filler: func(xid string) ([]byte, bool) {
 		return nil, true
 	}
 	user, _ := getUserBio(honk.Username)
-	rawhonks := gethonksbyThread(honk.UserID, honk.Thread, 0)
+	rawhonks := gethonksbyThread(honk.UserID, honk.Thread, 0, 0)
 	reverseSlice(rawhonks)
 	for _, h := range rawhonks {
 		if h.InReplyToID == honk.XID && h.Public && (h.Whofore == 2 || h.IsAcked()) {
@@ -17,13 +17,19 @@ package main
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"html"
 	"net"
 	"net/rpc"
 	"os"
 	"os/exec"
+	"regexp"
+	"time"
 
 	"github.com/benjojo/honk-benjojo/image"
 	"humungus.tedunangst.com/r/webs/gate"
+	"humungus.tedunangst.com/r/webs/junk"
 )
 
 type Shrinker struct {
@@ -32,14 +38,30 @@ type Shrinker struct {
 type ShrinkerArgs struct {
 	Buf    []byte
 	Params image.Params
+	Sizes  map[string]int
 }
 
 type ShrinkerResult struct {
-	Image *image.Image
+	Image      *image.Image
+	Renditions map[string]*image.Image
+}
+
+type rendition struct {
+	name string
+	size int
+}
+
+// smaller copies made of uploaded images, by longest side
+var renditions = []rendition{
+	{"small", 400},
+	{"medium", 1024},
 }
 
 var shrinkgate = gate.NewLimiter(4)
 
+// ++ make animations too big to keep into still images, instead of refusing them
+var stillGifs = true
+
 func (s *Shrinker) Shrink(args *ShrinkerArgs, res *ShrinkerResult) error {
 	shrinkgate.Start()
 	defer shrinkgate.Finish()
@@ -48,6 +70,28 @@ func (s *Shrinker) Shrink(args *ShrinkerArgs, res *ShrinkerResult) error {
 		return err
 	}
 	res.Image = img
+	// one copy of an animation is plenty
+	if img.Format == "gif" {
+		return nil
+	}
+	for name, size := range args.Sizes {
+		if img.Width <= size && img.Height <= size {
+			continue
+		}
+		// scale from the original, not the already compressed copy
+		params := args.Params
+		params.MaxWidth = size
+		params.MaxHeight = size
+		small, err := image.Vacuum(bytes.NewReader(args.Buf), params)
+		if err != nil {
+			elog.Printf("error making %s rendition: %s", name, err)
+			continue
+		}
+		if res.Renditions == nil {
+			res.Renditions = make(map[string]*image.Image)
+		}
+		res.Renditions[name] = small
+	}
 	return nil
 }
 
@@ -56,20 +100,220 @@ func backendSockname() string {
 }
 
 func shrinkit(data []byte) (*image.Image, error) {
+	res, err := callshrinker(data, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Image, nil
+}
+
+// shrinkwithrenditions also returns smaller copies, to be saved with saveRenditions
+func shrinkwithrenditions(data []byte) (*image.Image, map[string]*image.Image, error) {
+	sizes := make(map[string]int)
+	for _, r := range renditions {
+		sizes[r.name] = r.size
+	}
+	res, err := callshrinker(data, sizes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return res.Image, res.Renditions, nil
+}
+
+var errNoBackend = errors.New("backend unavailable")
+
+// callshrinker tries again if the backend has gone away, in case it's
+// being restarted. Errors from the shrinker itself are returned as is.
+func callshrinker(data []byte, sizes map[string]int) (*ShrinkerResult, error) {
+	res, err := shrinkonce(data, sizes)
+	if _, ok := err.(rpc.ServerError); err == nil || ok {
+		return res, err
+	}
+	ilog.Printf("backend error, will retry: %s", err)
+	if !waitforbackend(10 * time.Second) {
+		return nil, fmt.Errorf("%w: %s", errNoBackend, err)
+	}
+	res, err = shrinkonce(data, sizes)
+	if _, ok := err.(rpc.ServerError); err != nil && !ok {
+		return nil, fmt.Errorf("%w: %s", errNoBackend, err)
+	}
+	return res, err
+}
+
+func shrinkonce(data []byte, sizes map[string]int) (*ShrinkerResult, error) {
 	cl, err := rpc.Dial("unix", backendSockname())
 	if err != nil {
 		return nil, err
 	}
 	defer cl.Close()
+	params := image.Params{
+		LimitSize:  8000 * 8000,
+		MaxWidth:   2048,
+		MaxHeight:  2048,
+		StillAnims: stillGifs,
+	}
 	var res ShrinkerResult
 	err = cl.Call("Shrinker.Shrink", &ShrinkerArgs{
 		Buf:    data,
-		Params: image.Params{LimitSize: 8000 * 8000, MaxWidth: 2048, MaxHeight: 2048},
+		Params: params,
+		Sizes:  sizes,
 	}, &res)
 	if err != nil {
 		return nil, err
 	}
-	return res.Image, nil
+	return &res, nil
+}
+
+// Sanitizer cleans up remote html, so the main process
+// only ever parses our own well formed output.
+type Sanitizer struct {
+}
+
+type SanitizeArgs struct {
+	Texts   []string
+	BaseURL string
+}
+
+type SanitizeResult struct {
+	Texts []string
+}
+
+func (s *Sanitizer) Clean(args *SanitizeArgs, res *SanitizeResult) error {
+	for _, t := range args.Texts {
+		res.Texts = append(res.Texts, cleanhtml(t, args.BaseURL))
+	}
+	return nil
+}
+
+var re_anytag = regexp.MustCompile(`<[^>]*>`)
+
+// sanitizehtml cleans each of texts in the backend.
+// If the backend isn't available, the text is kept as escaped plain text.
+func sanitizehtml(baseurl string, texts ...string) []string {
+	var res SanitizeResult
+	err := callbackend("Sanitizer.Clean", &SanitizeArgs{Texts: texts, BaseURL: baseurl}, &res)
+	if err == nil && len(res.Texts) == len(texts) {
+		return res.Texts
+	}
+	ilog.Printf("can't sanitize, keeping plain text: %v", err)
+	var cleaned []string
+	for _, t := range texts {
+		cleaned = append(cleaned, html.EscapeString(re_anytag.ReplaceAllString(t, " ")))
+	}
+	return cleaned
+}
+
+// Prober works out what a file really is
+type Prober struct {
+}
+
+type ProbeArgs struct {
+	Buf []byte
+}
+
+func (p *Prober) Probe(args *ProbeArgs, res *MediaInfo) error {
+	*res = *probemedia(args.Buf)
+	return nil
+}
+
+// probeit works out a file in the backend.
+// Without the backend nothing is known, and errNoBackend is returned.
+func probeit(data []byte) (*MediaInfo, error) {
+	var res MediaInfo
+	err := callbackend("Prober.Probe", &ProbeArgs{Buf: data}, &res)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errNoBackend, err)
+	}
+	return &res, nil
+}
+
+// Junker decodes remote json, so the main process
+// only ever decodes our own well formed output.
+type Junker struct {
+}
+
+type JunkArgs struct {
+	Buf []byte
+}
+
+type JunkResult struct {
+	Buf []byte
+}
+
+func (jk *Junker) Decode(args *JunkArgs, res *JunkResult) error {
+	j, err := junk.FromBytes(args.Buf)
+	if err != nil {
+		return err
+	}
+	res.Buf = j.ToBytes()
+	return nil
+}
+
+// parsejunk decodes remote json in the backend.
+func parsejunk(data []byte) (junk.Junk, error) {
+	var res JunkResult
+	err := callbackend("Junker.Decode", &JunkArgs{Buf: data}, &res)
+	if err != nil {
+		if _, ok := err.(rpc.ServerError); !ok {
+			err = fmt.Errorf("%w: %s", errNoBackend, err)
+		}
+		return nil, err
+	}
+	return junk.FromBytes(res.Buf)
+}
+
+func callbackend(method string, args interface{}, res interface{}) error {
+	cl, err := rpc.Dial("unix", backendSockname())
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	return cl.Call(method, args, res)
+}
+
+// Health answers pings, so a stuck backend can be noticed
+type Health struct {
+}
+
+func (h *Health) Ping(args *int, res *int) error {
+	*res = *args
+	return nil
+}
+
+const backendPingInterval = 30 * time.Second
+const backendPingTimeout = 10 * time.Second
+
+// three missed pings in a row and the backend is killed and restarted
+const backendPingFailures = 3
+
+func pingbackend() error {
+	conn, err := net.DialTimeout("unix", backendSockname(), backendPingTimeout)
+	if err != nil {
+		return err
+	}
+	cl := rpc.NewClient(conn)
+	defer cl.Close()
+	args, res := 1, 0
+	call := cl.Go("Health.Ping", &args, &res, nil)
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-time.After(backendPingTimeout):
+		return fmt.Errorf("ping timed out")
+	}
+}
+
+func waitforbackend(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if pingbackend() == nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
 }
 
 var backendhooks []func()
@@ -90,6 +334,22 @@ func backendServer() {
 	if err != nil {
 		elog.Panicf("unable to register shrinker: %s", err)
 	}
+	err = srv.Register(new(Sanitizer))
+	if err != nil {
+		elog.Panicf("unable to register sanitizer: %s", err)
+	}
+	err = srv.Register(new(Prober))
+	if err != nil {
+		elog.Panicf("unable to register prober: %s", err)
+	}
+	err = srv.Register(new(Junker))
+	if err != nil {
+		elog.Panicf("unable to register junker: %s", err)
+	}
+	err = srv.Register(new(Health))
+	if err != nil {
+		elog.Panicf("unable to register health: %s", err)
+	}
 
 	sockname := backendSockname()
 	err = os.Remove(sockname)
@@ -112,21 +372,73 @@ func backendServer() {
 }
 
 func runBackendServer() {
+	go superviseBackend()
+}
+
+// superviseBackend restarts the backend whenever it exits,
+// backing off if it keeps dying right away.
+func superviseBackend() {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := runBackendOnce()
+		elog.Printf("lost the backend: %v", err)
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+		ilog.Printf("restarting backend in %s", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+func runBackendOnce() error {
 	r, w, err := os.Pipe()
 	if err != nil {
-		elog.Panicf("can't pipe: %s", err)
+		return err
 	}
+	// closing our end of the pipe tells the backend to quit
+	defer w.Close()
 	proc := exec.Command(os.Args[0], reexecArgs("backend")...)
 	proc.Stdout = os.Stdout
 	proc.Stderr = os.Stderr
 	proc.Stdin = r
 	err = proc.Start()
+	r.Close()
 	if err != nil {
-		elog.Panicf("can't exec backend: %s", err)
+		return fmt.Errorf("can't exec backend: %w", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go watchBackend(proc, done)
+	return proc.Wait()
+}
+
+// watchBackend kills a backend that stops answering, so it can be restarted
+func watchBackend(proc *exec.Cmd, done chan struct{}) {
+	ticker := time.NewTicker(backendPingInterval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		err := pingbackend()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		failures++
+		ilog.Printf("backend ping failed: %s", err)
+		if failures >= backendPingFailures {
+			elog.Printf("backend not responding, killing it")
+			proc.Process.Kill()
+			return
+		}
 	}
-	go func() {
-		proc.Wait()
-		elog.Printf("lost the backend: %s", err)
-		w.Close()
-	}()
 }
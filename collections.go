@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Collection is a named bunch of honks a user wants to keep.
+// A honk may be in any number of them.
+type Collection struct {
+	ID     int64
+	UserID int64
+	Name   string
+	Notes  string
+	Date   time.Time
+	Count  int64
+}
+
+// saving a honk puts it in this collection
+const savedCollection = "saved"
+
+var errNoCollectionName = errors.New("collection needs a name")
+
+func scancollection(row RowLike) *Collection {
+	c := new(Collection)
+	var dt string
+	err := row.Scan(&c.ID, &c.UserID, &c.Name, &c.Notes, &dt, &c.Count)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			elog.Printf("error scanning collection: %s", err)
+		}
+		return nil
+	}
+	c.Date, _ = time.Parse(dbtimeformat, dt)
+	return c
+}
+
+func getCollections(userid int64) []*Collection {
+	rows, err := stmtGetCollections.Query(userid)
+	if err != nil {
+		elog.Printf("error querying collections: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var collections []*Collection
+	for rows.Next() {
+		if c := scancollection(rows); c != nil {
+			collections = append(collections, c)
+		}
+	}
+	return collections
+}
+
+func getCollection(userid int64, name string) *Collection {
+	row := stmtGetCollection.QueryRow(userid, name)
+	return scancollection(row)
+}
+
+// saveCollection creates a collection, or renames the one with the same ID
+func saveCollection(c *Collection) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return errNoCollectionName
+	}
+	if other := getCollection(c.UserID, c.Name); other != nil && other.ID != c.ID {
+		return fmt.Errorf("there is already a collection named %s", c.Name)
+	}
+	if c.ID != 0 {
+		_, err := stmtUpdateCollection.Exec(c.Name, c.Notes, c.ID, c.UserID)
+		return err
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	res, err := stmtSaveCollection.Exec(c.UserID, c.Name, c.Notes, dt)
+	if err != nil {
+		return err
+	}
+	c.ID, _ = res.LastInsertId()
+	return nil
+}
+
+func deleteCollection(userid int64, collectionid int64) error {
+	res, err := stmtDeleteCollection.Exec(collectionid, userid)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = stmtClearCollection.Exec(collectionid)
+	return err
+}
+
+// collecthonk adds a honk to the named collection, creating it if need be
+func collecthonk(userid int64, name string, honkid int64) error {
+	c := getCollection(userid, strings.TrimSpace(name))
+	if c == nil {
+		c = &Collection{UserID: userid, Name: name}
+		err := saveCollection(c)
+		if err != nil {
+			return err
+		}
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	_, err := stmtCollectHonk.Exec(c.ID, honkid, dt, c.ID, honkid)
+	return err
+}
+
+func uncollecthonk(userid int64, name string, honkid int64) error {
+	c := getCollection(userid, name)
+	if c == nil {
+		return nil
+	}
+	_, err := stmtUncollectHonk.Exec(c.ID, honkid)
+	return err
+}
+
+func gethonksbycollection(userid int64, collectionid int64) []*ActivityPubActivity {
+	rows, err := stmtHonksByCollection.Query(collectionid, userid)
+	return getsomehonks(rows, err)
+}
+
+// collectionmarkdown lists a collection as a markdown document
+func collectionmarkdown(c *Collection, honks []*ActivityPubActivity) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# %s\n\n", c.Name)
+	if c.Notes != "" {
+		fmt.Fprintf(&buf, "%s\n\n", c.Notes)
+	}
+	for _, h := range honks {
+		url := h.URL
+		if url == "" {
+			url = h.XID
+		}
+		_, handle := handles(h.Author)
+		fmt.Fprintf(&buf, "- [%s](%s) %s\n", handle, url, h.Date.UTC().Format("2006-01-02"))
+		text := h.Precis
+		if text == "" {
+			text = revisiontext(h.Text, h.Format)
+		}
+		text = strings.Join(strings.Fields(text), " ")
+		if r := []rune(text); len(r) > 280 {
+			text = string(r[:280]) + "..."
+		}
+		if text != "" {
+			fmt.Fprintf(&buf, "  %s\n", text)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,505 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Just enough of the audio and video container formats to check a file
+// is what it claims, and learn its size and length.
+
+var errShort = fmt.Errorf("file truncated")
+
+func seconds(s float64) Duration {
+	return Duration(s * float64(time.Second))
+}
+
+// mp4 and m4a, a tree of boxes
+func probemp4(data []byte) (*MediaInfo, error) {
+	if len(data) < 8 || string(data[4:8]) != "ftyp" {
+		return nil, fmt.Errorf("no ftyp box")
+	}
+	info := &MediaInfo{Media: "audio/mp4"}
+	var moov []byte
+	err := mp4boxes(data, func(kind string, box []byte) error {
+		if kind == "moov" {
+			moov = box
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if moov == nil {
+		return nil, fmt.Errorf("no moov box")
+	}
+	sound := false
+	err = mp4boxes(moov, func(kind string, box []byte) error {
+		switch kind {
+		case "mvhd":
+			d, err := mp4duration(box)
+			if err != nil {
+				return err
+			}
+			info.Duration = d
+		case "trak":
+			var width, height int
+			var handler string
+			err := mp4boxes(box, func(kind string, box []byte) error {
+				switch kind {
+				case "tkhd":
+					width, height = mp4size(box)
+				case "mdia":
+					return mp4boxes(box, func(kind string, box []byte) error {
+						// version, flags, predefined, then the type
+						if kind == "hdlr" && len(box) >= 12 {
+							handler = string(box[8:12])
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			switch handler {
+			case "vide":
+				info.Media = "video/mp4"
+				if width > info.Width {
+					info.Width, info.Height = width, height
+				}
+			case "soun":
+				sound = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Media == "audio/mp4" && !sound {
+		return nil, fmt.Errorf("no tracks")
+	}
+	return info, nil
+}
+
+func mp4boxes(data []byte, fn func(kind string, box []byte) error) error {
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return errShort
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		kind := string(data[4:8])
+		hdr := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return errShort
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			hdr = 16
+		}
+		if size < hdr || size > uint64(len(data)) {
+			return errShort
+		}
+		err := fn(kind, data[hdr:size])
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func mp4duration(mvhd []byte) (Duration, error) {
+	if len(mvhd) < 1 {
+		return 0, errShort
+	}
+	var scale, length uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0, errShort
+		}
+		scale = uint64(binary.BigEndian.Uint32(mvhd[20:]))
+		length = binary.BigEndian.Uint64(mvhd[24:])
+	} else {
+		if len(mvhd) < 20 {
+			return 0, errShort
+		}
+		scale = uint64(binary.BigEndian.Uint32(mvhd[12:]))
+		length = uint64(binary.BigEndian.Uint32(mvhd[16:]))
+	}
+	if scale == 0 {
+		return 0, fmt.Errorf("no timescale")
+	}
+	return seconds(float64(length) / float64(scale)), nil
+}
+
+// the size is at the very end of tkhd, in 16.16 fixed point
+func mp4size(tkhd []byte) (int, int) {
+	if len(tkhd) < 8 {
+		return 0, 0
+	}
+	end := len(tkhd)
+	w := binary.BigEndian.Uint32(tkhd[end-8:])
+	h := binary.BigEndian.Uint32(tkhd[end-4:])
+	return int(w >> 16), int(h >> 16)
+}
+
+var mp3bitrates = [2][16]int{
+	{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, -1},
+	{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, -1},
+}
+var mp3rates = [3][3]int{
+	{44100, 48000, 32000},
+	{22050, 24000, 16000},
+	{11025, 12000, 8000},
+}
+
+type mp3frame struct {
+	mpeg1    bool
+	mono     bool
+	bitrate  int
+	rate     int
+	length   int
+	samples  int
+	sideinfo int
+}
+
+// only layer III, nobody has anything else
+func mp3header(data []byte) (*mp3frame, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1]&0xe0 != 0xe0 {
+		return nil, fmt.Errorf("no frame sync")
+	}
+	version := data[1] >> 3 & 3
+	layer := data[1] >> 1 & 3
+	if version == 1 || layer != 1 {
+		return nil, fmt.Errorf("not mpeg layer 3")
+	}
+	f := new(mp3frame)
+	f.mpeg1 = version == 3
+	vidx := 0
+	switch version {
+	case 2:
+		vidx = 1
+	case 0:
+		vidx = 2
+	}
+	bidx := 0
+	if !f.mpeg1 {
+		bidx = 1
+	}
+	f.bitrate = mp3bitrates[bidx][data[2]>>4]
+	ridx := data[2] >> 2 & 3
+	if f.bitrate <= 0 || ridx == 3 {
+		return nil, fmt.Errorf("bad mp3 header")
+	}
+	f.rate = mp3rates[vidx][ridx]
+	padding := int(data[2] >> 1 & 1)
+	f.mono = data[3]>>6 == 3
+	if f.mpeg1 {
+		f.samples = 1152
+		f.length = 144*f.bitrate*1000/f.rate + padding
+		f.sideinfo = 32
+		if f.mono {
+			f.sideinfo = 17
+		}
+	} else {
+		f.samples = 576
+		f.length = 72*f.bitrate*1000/f.rate + padding
+		f.sideinfo = 17
+		if f.mono {
+			f.sideinfo = 9
+		}
+	}
+	return f, nil
+}
+
+func probemp3(data []byte) (*MediaInfo, error) {
+	start := 0
+	// skip the ID3v2 tag, which has a syncsafe size
+	if len(data) >= 10 && string(data[0:3]) == "ID3" {
+		size := int(data[6]&0x7f)<<21 | int(data[7]&0x7f)<<14 | int(data[8]&0x7f)<<7 | int(data[9]&0x7f)
+		start = 10 + size
+		if data[5]&0x10 != 0 {
+			start += 10
+		}
+	}
+	if start >= len(data) {
+		return nil, errShort
+	}
+	f, err := mp3header(data[start:])
+	if err != nil {
+		return nil, err
+	}
+	// one sync could be chance, two in a row is an mp3
+	if start+f.length > len(data) {
+		return nil, errShort
+	}
+	if _, err := mp3header(data[start+f.length:]); err != nil {
+		return nil, fmt.Errorf("second frame: %w", err)
+	}
+	info := &MediaInfo{Media: "audio/mpeg"}
+	// variable bitrate files say how many frames there are
+	xing := start + 4 + f.sideinfo
+	if xing+12 <= len(data) {
+		tag := string(data[xing : xing+4])
+		flags := binary.BigEndian.Uint32(data[xing+4:])
+		if (tag == "Xing" || tag == "Info") && flags&1 != 0 {
+			frames := binary.BigEndian.Uint32(data[xing+8:])
+			info.Duration = seconds(float64(frames) * float64(f.samples) / float64(f.rate))
+			return info, nil
+		}
+	}
+	info.Duration = seconds(float64(len(data)-start) * 8 / float64(f.bitrate*1000))
+	return info, nil
+}
+
+// ogg pages, holding opus or vorbis
+func probeogg(data []byte) (*MediaInfo, error) {
+	page, body, err := oggpage(data)
+	if err != nil {
+		return nil, err
+	}
+	serial := binary.LittleEndian.Uint32(page[14:])
+	var rate, preskip uint64
+	switch {
+	case bytes.HasPrefix(body, []byte("OpusHead")) && len(body) >= 19:
+		// opus always counts at 48kHz
+		rate = 48000
+		preskip = uint64(binary.LittleEndian.Uint16(body[10:]))
+	case bytes.HasPrefix(body, []byte("\x01vorbis")) && len(body) >= 16:
+		rate = uint64(binary.LittleEndian.Uint32(body[12:]))
+	default:
+		return nil, fmt.Errorf("unknown ogg codec")
+	}
+	if rate == 0 {
+		return nil, fmt.Errorf("no sample rate")
+	}
+	info := &MediaInfo{Media: "audio/ogg"}
+	// the last page of the stream has the final sample position
+	for i := len(data) - 27; i >= 0; i-- {
+		i = bytes.LastIndex(data[:i+4], []byte("OggS"))
+		if i == -1 {
+			break
+		}
+		page, _, err := oggpage(data[i:])
+		if err != nil || binary.LittleEndian.Uint32(page[14:]) != serial {
+			continue
+		}
+		granule := binary.LittleEndian.Uint64(page[6:])
+		if granule != math.MaxUint64 && granule > preskip {
+			info.Duration = seconds(float64(granule-preskip) / float64(rate))
+			break
+		}
+	}
+	return info, nil
+}
+
+// oggpage returns the header and the contents of the page at data
+func oggpage(data []byte) ([]byte, []byte, error) {
+	if len(data) < 27 || string(data[0:4]) != "OggS" || data[4] != 0 {
+		return nil, nil, fmt.Errorf("not an ogg page")
+	}
+	nsegs := int(data[26])
+	hdr := 27 + nsegs
+	if len(data) < hdr {
+		return nil, nil, errShort
+	}
+	size := 0
+	for _, s := range data[27:hdr] {
+		size += int(s)
+	}
+	if len(data) < hdr+size {
+		return nil, nil, errShort
+	}
+	return data[:hdr], data[hdr : hdr+size], nil
+}
+
+// ebml element ids used by webm
+const (
+	ebmlHeader     = 0x1a45dfa3
+	ebmlDocType    = 0x4282
+	mkvSegment     = 0x18538067
+	mkvInfo        = 0x1549a966
+	mkvTimeScale   = 0x2ad7b1
+	mkvDuration    = 0x4489
+	mkvTracks      = 0x1654ae6b
+	mkvTrackEntry  = 0xae
+	mkvTrackType   = 0x83
+	mkvVideo       = 0xe0
+	mkvPixelWidth  = 0xb0
+	mkvPixelHeight = 0xba
+	mkvCluster     = 0x1f43b675
+)
+
+// ebmlvint reads a variable length number, keeping the length marker
+// for ids and removing it for sizes. An all ones size is unknown.
+func ebmlvint(data []byte, id bool) (uint64, int, bool, error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false, fmt.Errorf("bad ebml number")
+	}
+	n := 1
+	for data[0]&(0x80>>(n-1)) == 0 {
+		n++
+	}
+	if n > 8 || len(data) < n {
+		return 0, 0, false, errShort
+	}
+	v := uint64(data[0])
+	if !id {
+		v &= 0xff >> n
+	}
+	allones := v == 0xff>>n
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+		allones = allones && b == 0xff
+	}
+	return v, n, allones && !id, nil
+}
+
+func ebmlelements(data []byte, fn func(id uint64, el []byte) error) error {
+	for len(data) > 0 {
+		id, n, _, err := ebmlvint(data, true)
+		if err != nil {
+			return err
+		}
+		size, m, unknown, err := ebmlvint(data[n:], false)
+		if err != nil {
+			return err
+		}
+		data = data[n+m:]
+		if unknown {
+			// only allowed for segments and clusters, runs to the end
+			size = uint64(len(data))
+		}
+		if size > uint64(len(data)) {
+			return errShort
+		}
+		err = fn(id, data[:size])
+		if err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+func ebmluint(el []byte) uint64 {
+	var v uint64
+	for _, b := range el {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func ebmlfloat(el []byte) float64 {
+	switch len(el) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(el)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(el))
+	}
+	return 0
+}
+
+func probewebm(data []byte) (*MediaInfo, error) {
+	if len(data) < 4 || binary.BigEndian.Uint32(data) != ebmlHeader {
+		return nil, fmt.Errorf("no ebml header")
+	}
+	info := &MediaInfo{Media: "audio/webm"}
+	doctype := ""
+	scale := uint64(1000000)
+	var length float64
+	tracks := 0
+	// a cluster with unknown size may run to the end, which is fine,
+	// but a truncated upload is reported once we know what it is
+	err := ebmlelements(data, func(id uint64, el []byte) error {
+		switch id {
+		case ebmlHeader:
+			return ebmlelements(el, func(id uint64, el []byte) error {
+				if id == ebmlDocType {
+					doctype = string(el)
+				}
+				return nil
+			})
+		case mkvSegment:
+			return ebmlelements(el, func(id uint64, el []byte) error {
+				switch id {
+				case mkvInfo:
+					return ebmlelements(el, func(id uint64, el []byte) error {
+						switch id {
+						case mkvTimeScale:
+							scale = ebmluint(el)
+						case mkvDuration:
+							length = ebmlfloat(el)
+						}
+						return nil
+					})
+				case mkvTracks:
+					return ebmlelements(el, func(id uint64, el []byte) error {
+						if id != mkvTrackEntry {
+							return nil
+						}
+						tracks++
+						return ebmlelements(el, func(id uint64, el []byte) error {
+							switch id {
+							case mkvTrackType:
+								if ebmluint(el) == 1 {
+									info.Media = "video/webm"
+								}
+							case mkvVideo:
+								return ebmlelements(el, func(id uint64, el []byte) error {
+									switch id {
+									case mkvPixelWidth:
+										info.Width = int(ebmluint(el))
+									case mkvPixelHeight:
+										info.Height = int(ebmluint(el))
+									}
+									return nil
+								})
+							}
+							return nil
+						})
+					})
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if doctype != "webm" && doctype != "matroska" {
+		return nil, fmt.Errorf("unknown doctype: %s", doctype)
+	}
+	if tracks == 0 {
+		return nil, fmt.Errorf("no tracks")
+	}
+	if length > 0 && !math.IsInf(length, 0) {
+		info.Duration = Duration(length * float64(scale))
+	}
+	return info, nil
+}
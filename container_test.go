@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+func mp4box(kind string, contents ...[]byte) []byte {
+	body := bytes.Join(contents, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], kind)
+	return append(box, body...)
+}
+
+// a version 0 mvhd, only as long as the parts we read
+func mp4mvhd(scale, length uint32) []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[12:], scale)
+	binary.BigEndian.PutUint32(b[16:], length)
+	return mp4box("mvhd", b)
+}
+
+func mp4trak(handler string, width, height int) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width<<16))
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height<<16))
+	hdlr := make([]byte, 24)
+	copy(hdlr[8:], handler)
+	return mp4box("trak", mp4box("tkhd", tkhd), mp4box("mdia", mp4box("hdlr", hdlr)))
+}
+
+func samplemp4(traks ...[]byte) []byte {
+	ftyp := mp4box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2"))
+	moov := mp4box("moov", append([][]byte{mp4mvhd(1000, 2500)}, traks...)...)
+	return append(ftyp, moov...)
+}
+
+// mpeg 1 layer III, 128kbps at 44.1kHz, 417 bytes a frame
+func mp3frames(n int, xing uint32) []byte {
+	var data []byte
+	for i := 0; i < n; i++ {
+		frame := make([]byte, 417)
+		copy(frame, []byte{0xff, 0xfb, 0x90, 0x00})
+		if i == 0 && xing != 0 {
+			copy(frame[36:], "Xing")
+			binary.BigEndian.PutUint32(frame[40:], 1)
+			binary.BigEndian.PutUint32(frame[44:], xing)
+		}
+		data = append(data, frame...)
+	}
+	return data
+}
+
+func samplemp3(xing uint32) []byte {
+	id3 := []byte("ID3\x04\x00\x00\x00\x00\x00\x0a")
+	id3 = append(id3, make([]byte, 10)...)
+	return append(id3, mp3frames(2, xing)...)
+}
+
+func oggpagebytes(serial uint32, granule uint64, body []byte) []byte {
+	page := make([]byte, 27)
+	copy(page, "OggS")
+	binary.LittleEndian.PutUint64(page[6:], granule)
+	binary.LittleEndian.PutUint32(page[14:], serial)
+	page[26] = 1
+	page = append(page, byte(len(body)))
+	return append(page, body...)
+}
+
+func sampleogg() []byte {
+	head := []byte("OpusHead\x01\x02")
+	head = binary.LittleEndian.AppendUint16(head, 312)
+	head = binary.LittleEndian.AppendUint32(head, 44100)
+	head = append(head, 0, 0, 0)
+	data := oggpagebytes(7, 0, head)
+	data = append(data, oggpagebytes(7, 0, []byte("OpusTags"))...)
+	data = append(data, oggpagebytes(9, 999999999, []byte("other stream"))...)
+	data = append(data, oggpagebytes(7, 3*48000+312, []byte("audio"))...)
+	return data
+}
+
+// ebml with every size written out in eight bytes
+func ebml(id uint64, contents ...[]byte) []byte {
+	var el []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(el) > 0 {
+			el = append(el, b)
+		}
+	}
+	body := bytes.Join(contents, nil)
+	size := make([]byte, 8)
+	binary.BigEndian.PutUint64(size, uint64(len(body)))
+	size[0] = 0x01
+	el = append(el, size...)
+	return append(el, body...)
+}
+
+func ebmlfloat64(f float64) []byte {
+	return binary.BigEndian.AppendUint64(nil, math.Float64bits(f))
+}
+
+func samplewebm(video bool) []byte {
+	track := ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{2}))
+	if video {
+		track = ebml(mkvTrackEntry, ebml(mkvTrackType, []byte{1}),
+			ebml(mkvVideo, ebml(mkvPixelWidth, []byte{0x01, 0x40}), ebml(mkvPixelHeight, []byte{0xf0})))
+	}
+	segment := ebml(mkvSegment,
+		ebml(mkvInfo, ebml(mkvTimeScale, []byte{0x0f, 0x42, 0x40}), ebml(mkvDuration, ebmlfloat64(2500))),
+		ebml(mkvTracks, track))
+	return append(ebml(ebmlHeader, ebml(ebmlDocType, []byte("webm"))), segment...)
+}
+
+func TestProbeContainers(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  func([]byte) (*MediaInfo, error)
+		data   []byte
+		media  string
+		width  int
+		height int
+		dur    time.Duration
+		bad    bool
+	}{
+		{name: "mp4 video", probe: probemp4, data: samplemp4(mp4trak("soun", 0, 0), mp4trak("vide", 640, 480)),
+			media: "video/mp4", width: 640, height: 480, dur: 2500 * time.Millisecond},
+		{name: "mp4 audio", probe: probemp4, data: samplemp4(mp4trak("soun", 0, 0)),
+			media: "audio/mp4", dur: 2500 * time.Millisecond},
+		{name: "mp4 no tracks", probe: probemp4, data: samplemp4(), bad: true},
+		{name: "mp4 no moov", probe: probemp4, data: mp4box("ftyp", []byte("isom")), bad: true},
+		{name: "mp4 truncated", probe: probemp4, data: samplemp4(mp4trak("vide", 640, 480))[:100], bad: true},
+		{name: "mp4 bogus size", probe: probemp4, data: append(mp4box("ftyp", []byte("isom")), 0, 0, 0, 1, 'm', 'o', 'o', 'v'), bad: true},
+		{name: "mp3", probe: probemp3, data: samplemp3(0),
+			media: "audio/mpeg", dur: 52125 * time.Microsecond},
+		{name: "mp3 vbr", probe: probemp3, data: samplemp3(100),
+			media: "audio/mpeg", dur: time.Duration(seconds(100 * 1152.0 / 44100))},
+		{name: "mp3 one frame", probe: probemp3, data: samplemp3(0)[:20+417], bad: true},
+		{name: "mp3 truncated", probe: probemp3, data: samplemp3(0)[:300], bad: true},
+		{name: "mp3 tag only", probe: probemp3, data: samplemp3(0)[:20], bad: true},
+		{name: "ogg opus", probe: probeogg, data: sampleogg(), media: "audio/ogg", dur: 3 * time.Second},
+		{name: "ogg truncated", probe: probeogg, data: sampleogg()[:30], bad: true},
+		{name: "ogg unknown", probe: probeogg, data: oggpagebytes(1, 0, []byte("FLAC is nice")), bad: true},
+		{name: "webm video", probe: probewebm, data: samplewebm(true),
+			media: "video/webm", width: 320, height: 240, dur: 2500 * time.Millisecond},
+		{name: "webm audio", probe: probewebm, data: samplewebm(false),
+			media: "audio/webm", dur: 2500 * time.Millisecond},
+		{name: "webm truncated", probe: probewebm, data: samplewebm(true)[:60], bad: true},
+		{name: "webm no tracks", probe: probewebm, data: ebml(ebmlHeader, ebml(ebmlDocType, []byte("webm"))), bad: true},
+		{name: "webm other doctype", probe: probewebm,
+			data: append(ebml(ebmlHeader, ebml(ebmlDocType, []byte("avi"))), samplewebm(true)[24:]...), bad: true},
+	}
+	for _, test := range tests {
+		info, err := test.probe(test.data)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%s: expected error, got %+v", test.name, info)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if info.Media != test.media || info.Width != test.width || info.Height != test.height {
+			t.Errorf("%s: got %s %dx%d", test.name, info.Media, info.Width, info.Height)
+		}
+		if d := time.Duration(info.Duration); d != test.dur {
+			t.Errorf("%s: got duration %s, expected %s", test.name, d, test.dur)
+		}
+	}
+}
+
+func TestEbmlvint(t *testing.T) {
+	tests := []struct {
+		in      []byte
+		id      bool
+		v       uint64
+		n       int
+		unknown bool
+		bad     bool
+	}{
+		{in: []byte{0x81}, v: 1, n: 1},
+		{in: []byte{0x81}, id: true, v: 0x81, n: 1},
+		{in: []byte{0x40, 0x02}, v: 2, n: 2},
+		{in: []byte{0x1a, 0x45, 0xdf, 0xa3}, id: true, v: ebmlHeader, n: 4},
+		{in: []byte{0xff}, v: 0x7f, n: 1, unknown: true},
+		{in: []byte{0x01, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, v: 1<<56 - 1, n: 8, unknown: true},
+		{in: []byte{0x40}, bad: true},
+		{in: []byte{0x00, 0x01}, bad: true},
+		{in: []byte{}, bad: true},
+	}
+	for _, test := range tests {
+		v, n, unknown, err := ebmlvint(test.in, test.id)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%x: expected error", test.in)
+			}
+			continue
+		}
+		if err != nil || v != test.v || n != test.n || unknown != test.unknown {
+			t.Errorf("%x: got %x %d %v %v", test.in, v, n, unknown, err)
+		}
+	}
+}
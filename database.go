@@ -24,8 +24,8 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
+	"math"
 	"sort"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -186,7 +186,16 @@ func getShare(userid int64, xid string) *ActivityPubActivity {
 func getpublichonks() []*ActivityPubActivity {
 	dt := getRetentionTimeForDB()
 	rows, err := stmtPublicHonks.Query(dt, 100)
-	return getsomehonks(rows, err)
+	honks := getsomehonks(rows, err)
+	j := 0
+	for _, h := range honks {
+		if policySilences(h.Author) || policySilences(h.Oonker) {
+			continue
+		}
+		honks[j] = h
+		j++
+	}
+	return honks[:j]
 }
 func geteventhonks(userid int64) []*ActivityPubActivity {
 	rows, err := stmtEventHonks.Query(userid, 25)
@@ -222,39 +231,48 @@ func geteventhonks(userid int64) []*ActivityPubActivity {
 
 var publicRetention = flag.Int("display.days", 7, "how many days you want to show in the outbox/user/etc")
 
-func gethonksbyuser(name string, includeprivate bool, wanted int64) []*ActivityPubActivity {
+func gethonksbyuser(name string, includeprivate bool, wanted int64, older int64) []*ActivityPubActivity {
 	dt := getRetentionTimeForDB()
 	limit := 50
 	whofore := 2
 	if includeprivate {
 		whofore = 3
 	}
-	rows, err := stmtUserHonks.Query(wanted, whofore, name, dt, limit)
+	rows, err := stmtUserHonks.Query(wanted, olderthan(older), whofore, name, dt, limit)
 	return getsomehonks(rows, err)
 }
 
+// olderthan turns an older cursor into an upper bound for honkid.
+// Zero means no bound.
+func olderthan(older int64) int64 {
+	if older <= 0 {
+		return math.MaxInt64
+	}
+	return older
+}
+
 func getRetentionTimeForDB() string {
 	dt := time.Now().Add(time.Duration(*publicRetention*-1) * 24 * time.Hour).UTC().Format(dbtimeformat)
 	return dt
 }
 
-func gethonksforuser(userid int64, wanted int64) []*ActivityPubActivity {
+func gethonksforuser(userid int64, wanted int64, older int64) []*ActivityPubActivity {
 	dt := getRetentionTimeForDB()
-	rows, err := stmtHonksForUser.Query(wanted, userid, dt, userid, userid)
+	rows, err := stmtHonksForUser.Query(wanted, olderthan(older), userid, dt, userid, userid)
 	return getsomehonks(rows, err)
 }
-func gethonksforuserfirstclass(userid int64, wanted int64) []*ActivityPubActivity {
+func gethonksforuserfirstclass(userid int64, wanted int64, older int64) []*ActivityPubActivity {
 	dt := getRetentionTimeForDB()
-	rows, err := stmtHonksForUserFirstClass.Query(wanted, userid, dt, userid, userid)
+	rows, err := stmtHonksForUserFirstClass.Query(wanted, olderthan(older), userid, dt, userid, userid)
 	return getsomehonks(rows, err)
 }
 
-func gethonksforme(userid int64, wanted int64) []*ActivityPubActivity {
+func gethonksforme(userid int64, wanted int64, older int64) []*ActivityPubActivity {
 	dt := getRetentionTimeForDB()
-	rows, err := stmtHonksForMe.Query(wanted, userid, dt, userid)
+	rows, err := stmtHonksForMe.Query(wanted, olderthan(older), userid, dt, userid)
 	return getsomehonks(rows, err)
 }
-func gethonksfromlongago(userid int64, wanted int64) []*ActivityPubActivity {
+func gethonksfromlongago(userid int64, wanted int64, older int64) []*ActivityPubActivity {
 	now := time.Now()
 	var honks []*ActivityPubActivity
 	for i := 1; i <= 3; i++ {
@@ -262,88 +280,35 @@ func gethonksfromlongago(userid int64, wanted int64) []*ActivityPubActivity {
 			now.Second(), 0, now.Location())
 		dt1 := dt.Add(-36 * time.Hour).UTC().Format(dbtimeformat)
 		dt2 := dt.Add(12 * time.Hour).UTC().Format(dbtimeformat)
-		rows, err := stmtHonksFromLongAgo.Query(wanted, userid, dt1, dt2, userid)
+		rows, err := stmtHonksFromLongAgo.Query(wanted, olderthan(older), userid, dt1, dt2, userid)
 		honks = append(honks, getsomehonks(rows, err)...)
 	}
 	return honks
 }
-func getsavedhonks(userid int64, wanted int64) []*ActivityPubActivity {
-	rows, err := stmtHonksISaved.Query(wanted, userid)
+func getsavedhonks(userid int64, wanted int64, older int64) []*ActivityPubActivity {
+	rows, err := stmtHonksISaved.Query(wanted, olderthan(older), userid, savedCollection)
 	return getsomehonks(rows, err)
 }
-func getHonksByAuthor(userid int64, author string, wanted int64) []*ActivityPubActivity {
-	rows, err := stmtHonksByAuthor.Query(wanted, userid, author, userid)
+func getHonksByAuthor(userid int64, author string, wanted int64, older int64) []*ActivityPubActivity {
+	rows, err := stmtHonksByAuthor.Query(wanted, olderthan(older), userid, author, userid)
 	return getsomehonks(rows, err)
 }
-func gethonksbyxonker(userid int64, xonker string, wanted int64) []*ActivityPubActivity {
-	rows, err := stmtHonksByXonker.Query(wanted, userid, xonker, xonker, userid)
+func gethonksbyxonker(userid int64, xonker string, wanted int64, older int64) []*ActivityPubActivity {
+	rows, err := stmtHonksByXonker.Query(wanted, olderthan(older), userid, xonker, xonker, userid)
 	return getsomehonks(rows, err)
 }
-func gethonksbycombo(userid int64, combo string, wanted int64) []*ActivityPubActivity {
+func gethonksbycombo(userid int64, combo string, wanted int64, older int64) []*ActivityPubActivity {
 	combo = "% " + combo + " %"
-	rows, err := stmtHonksByCombo.Query(wanted, userid, userid, combo, userid, wanted, userid, combo, userid)
+	rows, err := stmtHonksByCombo.Query(wanted, olderthan(older), userid, userid, combo, userid, wanted, olderthan(older), userid, combo, userid)
 	return getsomehonks(rows, err)
 }
-func gethonksbyThread(userid int64, thread string, wanted int64) []*ActivityPubActivity {
-	rows, err := stmtHonksByThread.Query(wanted, userid, userid, thread)
-	honks := getsomehonks(rows, err)
-	return honks
-}
-func gethonksbysearch(userid int64, q string, wanted int64) []*ActivityPubActivity {
-	var queries []string
-	var params []interface{}
-	queries = append(queries, "honks.honkid > ?")
-	params = append(params, wanted)
-	queries = append(queries, "honks.userid = ?")
-	params = append(params, userid)
-
-	terms := strings.Split(q, " ")
-	for _, t := range terms {
-		if t == "" {
-			continue
-		}
-		negate := " "
-		if t[0] == '-' {
-			t = t[1:]
-			negate = " not "
-		}
-		if t == "" {
-			continue
-		}
-		if strings.HasPrefix(t, "site:") {
-			site := t[5:]
-			site = "%" + site + "%"
-			queries = append(queries, "xid"+negate+"like ?")
-			params = append(params, site)
-			continue
-		}
-		if strings.HasPrefix(t, "author:") {
-			author := t[7:]
-			xid := fullname(author, userid)
-			if xid != "" {
-				author = xid
-			}
-			queries = append(queries, negate+"(honks.author = ? or honks.oonker = ?)")
-			params = append(params, author)
-			params = append(params, author)
-			continue
-		}
-		t = "%" + t + "%"
-		queries = append(queries, "text"+negate+"like ?")
-		params = append(params, t)
-	}
-
-	selecthonks := "select honks.honkid, honks.userid, username, what, author, oonker, honks.xid, rid, dt, url, audience, text, precis, format, thread, whofore, flags from honks join users on honks.userid = users.userid "
-	where := "where " + strings.Join(queries, " and ")
-	butnotthose := " and thread not in (select object from actions where userid = ? and action = 'mute-thread' order by actionID desc limit 100)"
-	limit := " order by honks.honkid desc limit 250"
-	params = append(params, userid)
-	rows, err := opendatabase().Query(selecthonks+where+butnotthose+limit, params...)
+func gethonksbyThread(userid int64, thread string, wanted int64, older int64) []*ActivityPubActivity {
+	rows, err := stmtHonksByThread.Query(wanted, olderthan(older), userid, userid, thread)
 	honks := getsomehonks(rows, err)
 	return honks
 }
-func getHonksByHashtag(userid int64, name string, wanted int64) []*ActivityPubActivity {
-	rows, err := stmtHonksByHashtag.Query(wanted, name, userid, userid)
+func getHonksByHashtag(userid int64, name string, wanted int64, older int64) []*ActivityPubActivity {
+	rows, err := stmtHonksByHashtag.Query(wanted, olderthan(older), name, userid, userid)
 	honks := getsomehonks(rows, err)
 	return honks
 }
@@ -400,10 +365,11 @@ func attachmentsForHonks(honks []*ActivityPubActivity) {
 	for _, h := range honks {
 		ids = append(ids, fmt.Sprintf("%d", h.ID))
 		hmap[h.ID] = h
+		h.Flags &^= flagIsSaved
 	}
 	idset := strings.Join(ids, ",")
 	// grab attachments
-	q := fmt.Sprintf("select honkid, attachments.fileid, xid, name, description, url, media, local from attachments join filemeta on attachments.fileid = filemeta.fileid where honkid in (%s)", idset)
+	q := fmt.Sprintf("select honkid, attachments.fileid, xid, name, description, url, media, local, blurhash, width, height, duration from attachments join filemeta on attachments.fileid = filemeta.fileid where honkid in (%s) order by attachments.rowid", idset)
 	rows, err := db.Query(q)
 	if err != nil {
 		elog.Printf("error querying attachments: %s", err)
@@ -413,7 +379,7 @@ func attachmentsForHonks(honks []*ActivityPubActivity) {
 	for rows.Next() {
 		var hid int64
 		d := new(Attachment)
-		err = rows.Scan(&hid, &d.FileID, &d.XID, &d.Name, &d.Desc, &d.URL, &d.Media, &d.Local)
+		err = rows.Scan(&hid, &d.FileID, &d.XID, &d.Name, &d.Desc, &d.URL, &d.Media, &d.Local, &d.Blurhash, &d.Width, &d.Height, &d.Duration)
 		if err != nil {
 			elog.Printf("error scanning attachment: %s", err)
 			continue
@@ -424,8 +390,27 @@ func attachmentsForHonks(honks []*ActivityPubActivity) {
 	}
 	rows.Close()
 
+	// grab saved, which is membership of the saved collection
+	q = fmt.Sprintf("select honkid from collected join collections on collected.collectionid = collections.collectionid where name = ? and honkid in (%s)", idset)
+	rows, err = db.Query(q, savedCollection)
+	if err != nil {
+		elog.Printf("error querying saved: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hid int64
+		err = rows.Scan(&hid)
+		if err != nil {
+			elog.Printf("error scanning saved: %s", err)
+			continue
+		}
+		hmap[hid].Flags |= flagIsSaved
+	}
+	rows.Close()
+
 	// grab hashtags
-	q = fmt.Sprintf("select honkid, hashtag from hashtags where honkid in (%s)", idset)
+	q = fmt.Sprintf("select honkid, tag from hashtags where honkid in (%s)", idset)
 	rows, err = db.Query(q)
 	if err != nil {
 		elog.Printf("error querying hashtags: %s", err)
@@ -446,7 +431,7 @@ func attachmentsForHonks(honks []*ActivityPubActivity) {
 	rows.Close()
 
 	// grab meta
-	q = fmt.Sprintf("select honkid, genus, json from honkmeta where honkid in (%s)", idset)
+	q = fmt.Sprintf("select honkid, genus, json from honkmeta where honkid in (%s) order by rowid", idset)
 	rows, err = db.Query(q)
 	if err != nil {
 		elog.Printf("error querying honkmeta: %s", err)
@@ -493,7 +478,16 @@ func attachmentsForHonks(honks []*ActivityPubActivity) {
 			}
 		case "guesses":
 			h.Guesses = template.HTML(j)
+		case "lang":
+			h.Lang = j
 		case "oldrev":
+			var rev OldRevision
+			err = json.Unmarshal([]byte(j), &rev)
+			if err != nil {
+				elog.Printf("error parsing oldrev: %s", err)
+				continue
+			}
+			h.Revisions = append(h.Revisions, rev)
 		default:
 			elog.Printf("unknown meta genus: %s", genus)
 		}
@@ -511,7 +505,7 @@ func attachmentsForChatMessages(chatMessages []*ChatMessage) {
 	}
 	idset := strings.Join(ids, ",")
 	// grab attachments
-	q := fmt.Sprintf("select chatMessageId, attachments.fileid, xid, name, description, url, media, local from attachments join filemeta on attachments.fileid = filemeta.fileid where chatMessageId in (%s)", idset)
+	q := fmt.Sprintf("select chatMessageId, attachments.fileid, xid, name, description, url, media, local, blurhash, width, height, duration from attachments join filemeta on attachments.fileid = filemeta.fileid where chatMessageId in (%s) order by attachments.rowid", idset)
 	rows, err := db.Query(q)
 	if err != nil {
 		elog.Printf("error querying attachments: %s", err)
@@ -521,7 +515,7 @@ func attachmentsForChatMessages(chatMessages []*ChatMessage) {
 	for rows.Next() {
 		var chid int64
 		d := new(Attachment)
-		err = rows.Scan(&chid, &d.FileID, &d.XID, &d.Name, &d.Desc, &d.URL, &d.Media, &d.Local)
+		err = rows.Scan(&chid, &d.FileID, &d.XID, &d.Name, &d.Desc, &d.URL, &d.Media, &d.Local, &d.Blurhash, &d.Width, &d.Height, &d.Duration)
 		if err != nil {
 			elog.Printf("error scanning attachment: %s", err)
 			continue
@@ -538,11 +532,13 @@ func hashfiledata(data []byte) string {
 }
 
 func saveFileBody(media string, data []byte) (string, error) {
-	var xid string
-
 	hash := hashfiledata(data)
-	row := stmtCheckFileData.QueryRow(hash)
-	if err := row.Scan(&xid); err == sql.ErrNoRows {
+	xid, ok, err := mediaStore.Lookup(hash)
+	if err != nil {
+		elog.Printf("error checking file hash: %s", err)
+		return "", err
+	}
+	if !ok {
 		xid = make18CharRandomString()
 		switch media {
 		case "image/png":
@@ -554,19 +550,20 @@ func saveFileBody(media string, data []byte) (string, error) {
 		case "text/plain":
 			xid += ".txt"
 		}
-		if _, err := stmtSaveFileData.Exec(xid, media, hash, data); err != nil {
+		if err := mediaStore.Save(xid, media, hash, data); err != nil {
 			return "", err
 		}
-	} else if err != nil {
-		elog.Printf("error checking file hash: %s", err)
-		return "", err
 	}
 	return xid, nil
 }
 
-func saveFileMetadata(xid, name, desc, url, media string) (retFileID int64, retErr error) {
+func saveFileMetadata(xid, name, desc, url, media string, info *MediaInfo) (retFileID int64, retErr error) {
 	haveLocalCopy := xid != ""
-	res, err := stmtSaveFile.Exec(xid, name, desc, url, media, haveLocalCopy)
+	if info == nil {
+		info = new(MediaInfo)
+	}
+	dt := time.Now().UTC().Format(dbtimeformat)
+	res, err := stmtSaveFile.Exec(xid, name, desc, url, media, haveLocalCopy, info.Blurhash, info.Width, info.Height, info.Duration, dt)
 	if err != nil {
 		return 0, err
 	}
@@ -574,11 +571,36 @@ func saveFileMetadata(xid, name, desc, url, media string) (retFileID int64, retE
 	return fileID, nil
 }
 
+// updateFileDesc changes the description of a file attached to honkid.
+// A file also attached elsewhere is copied first, and the new fileid returned.
+func updateFileDesc(honkid int64, fileid int64, desc string) (int64, error) {
+	var others int64
+	err := stmtFileSharers.QueryRow(fileid, honkid).Scan(&others)
+	if err != nil {
+		return 0, err
+	}
+	if others == 0 {
+		_, err = stmtUpdateFileDesc.Exec(desc, fileid)
+		return fileid, err
+	}
+	res, err := stmtCopyFile.Exec(desc, fileid)
+	if err != nil {
+		return 0, err
+	}
+	newid, _ := res.LastInsertId()
+	_, err = stmtRepointAttachment.Exec(newid, honkid, fileid)
+	if err != nil {
+		return 0, err
+	}
+	return newid, nil
+}
+
 func findAttachment(url string) *Attachment {
 	attachment := new(Attachment)
 	row := stmtFindFile.QueryRow(url)
-	err := row.Scan(&attachment.FileID, &attachment.XID)
+	err := row.Scan(&attachment.FileID, &attachment.XID, &attachment.Name, &attachment.Desc, &attachment.URL, &attachment.Media)
 	if err == nil {
+		attachment.Local = true
 		return attachment
 	}
 	if err != sql.ErrNoRows {
@@ -587,6 +609,17 @@ func findAttachment(url string) *Attachment {
 	return nil
 }
 
+// findRemoteFile finds an attachment we don't have, to proxy it
+func findRemoteFile(url string) int64 {
+	var fileid int64
+	row := stmtFindRemoteFile.QueryRow(url)
+	err := row.Scan(&fileid)
+	if err != nil && err != sql.ErrNoRows {
+		elog.Printf("error finding file: %s", err)
+	}
+	return fileid
+}
+
 func saveChatMessage(ch *ChatMessage) error {
 	dt := ch.Date.UTC().Format(dbtimeformat)
 	db := opendatabase()
@@ -789,7 +822,8 @@ func savehonk(h *ActivityPubActivity) error {
 
 func updateHonk(h *ActivityPubActivity) error {
 	old := getActivityPubActivity(h.UserID, h.XID)
-	oldrev := OldRevision{Precis: old.Precis, Text: old.Text}
+	oldrev := OldRevision{Precis: old.Precis, Text: old.Text, Format: old.Format, Date: time.Now().UTC()}
+	changed := old.Precis != h.Precis || old.Text != h.Text
 	dt := h.Date.UTC().Format(dbtimeformat)
 
 	db := opendatabase()
@@ -806,7 +840,7 @@ func updateHonk(h *ActivityPubActivity) error {
 	if err == nil {
 		err = saveextras(tx, h)
 	}
-	if err == nil {
+	if err == nil && changed {
 		var j string
 		j, err = encodeJson(&oldrev)
 		if err == nil {
@@ -902,6 +936,18 @@ func saveextras(tx *sql.Tx, h *ActivityPubActivity) error {
 			return err
 		}
 	}
+	if l := h.Lang; l != "" {
+		_, err := tx.Stmt(stmtSaveMeta).Exec(h.ID, "lang", l)
+		if err != nil {
+			elog.Printf("error saving lang: %s", err)
+			return err
+		}
+	}
+	err := searchindex(tx, h)
+	if err != nil {
+		elog.Printf("error saving search index: %s", err)
+		return err
+	}
 	return nil
 }
 
@@ -932,6 +978,10 @@ func deleteextras(tx *sql.Tx, honkid int64, everything bool) error {
 	if err != nil {
 		return err
 	}
+	_, err = tx.Stmt(stmtDeleteSearch).Exec(honkid)
+	if err != nil {
+		return err
+	}
 	if everything {
 		_, err = tx.Stmt(stmtDeleteAllMeta).Exec(honkid)
 	} else {
@@ -998,73 +1048,6 @@ func saveAuthor(user *UserProfile, url, name, flavor, combos, mj string) error {
 	return nil
 }
 
-func cleanupdb(arg string) {
-	db := opendatabase()
-	days, err := strconv.Atoi(arg)
-	var sqlargs []interface{}
-	var where string
-	if err != nil {
-		author := arg
-		expdate := time.Now().Add(-3 * 24 * time.Hour).UTC().Format(dbtimeformat)
-		where = "dt < ? and author = ?"
-		sqlargs = append(sqlargs, expdate)
-		sqlargs = append(sqlargs, author)
-	} else {
-		expdate := time.Now().Add(-time.Duration(days) * 24 * time.Hour).UTC().Format(dbtimeformat)
-		where = "dt < ? and thread not in (select thread from honks where flags & 4 or whofore = 2 or whofore = 3)"
-		sqlargs = append(sqlargs, expdate)
-	}
-	sqlMustQuery(db, "delete from honks where flags & 4 = 0 and whofore = 0 and "+where, sqlargs...)
-	sqlMustQuery(db, "delete from attachments where honkid > 0 and honkid not in (select honkid from honks)")
-	sqlMustQuery(db, "delete from hashtags where honkid not in (select honkid from honks)")
-	sqlMustQuery(db, "delete from honkmeta where honkid not in (select honkid from honks)")
-
-	sqlMustQuery(db, "delete from filemeta where fileid not in (select fileid from attachments)")
-	for _, u := range allusers() {
-		sqlMustQuery(db, "delete from actions where userid = ? and action = 'mute-thread' and actionID < (select actionID from actions where userid = ? and action = 'mute-thread' order by actionID desc limit 1 offset 200)", u.UserID, u.UserID)
-	}
-
-	filexids := make(map[string]bool)
-	blobdb := openblobdb()
-	rows, err := blobdb.Query("select xid from filedata")
-	if err != nil {
-		elog.Fatal(err)
-	}
-	for rows.Next() {
-		var xid string
-		err = rows.Scan(&xid)
-		if err != nil {
-			elog.Fatal(err)
-		}
-		filexids[xid] = true
-	}
-	rows.Close()
-	rows, err = db.Query("select xid from filemeta")
-	for rows.Next() {
-		var xid string
-		err = rows.Scan(&xid)
-		if err != nil {
-			elog.Fatal(err)
-		}
-		delete(filexids, xid)
-	}
-	rows.Close()
-	tx, err := blobdb.Begin()
-	if err != nil {
-		elog.Fatal(err)
-	}
-	for xid, _ := range filexids {
-		_, err = tx.Exec("delete from filedata where xid = ?", xid)
-		if err != nil {
-			elog.Fatal(err)
-		}
-	}
-	err = tx.Commit()
-	if err != nil {
-		elog.Fatal(err)
-	}
-}
-
 var stmtAuthors, stmtDubbers, stmtNamedDubbers, stmtSaveAuthor, stmtUpdateFlavor, stmtUpdateAuthor *sql.Stmt
 var stmtDeleteAuthor *sql.Stmt
 var stmtAnyXonk, stmtOneActivityPubActivity, stmtPublicHonks, stmtUserHonks, stmtHonksByCombo, stmtHonksByThread *sql.Stmt
@@ -1072,8 +1055,8 @@ var stmtHonksByHashtag, stmtHonksForUser, stmtHonksForMe, stmtSaveDub, stmtHonks
 var stmtHonksFromLongAgo *sql.Stmt
 var stmtHonksByAuthor, stmtSaveHonk, stmtUserByName, stmtUserByNumber *sql.Stmt
 var stmtEventHonks, stmtOneShare, stmtFindZonk, stmtFindXonk, stmtSaveAttachment *sql.Stmt
-var stmtFindFile, stmtGetFileData, stmtSaveFileData, stmtSaveFile *sql.Stmt
-var stmtCheckFileData *sql.Stmt
+var stmtFindFile, stmtSaveFile, stmtFindRemoteFile, stmtProxyFile, stmtProxyAllowed, stmtUpdateFileDesc *sql.Stmt
+var stmtFileSharers, stmtCopyFile, stmtRepointAttachment *sql.Stmt
 var stmtAddResubmission, stmtGetResubmissions, stmtLoadResubmission, stmtDeleteResubmission, stmtOneAuthor *sql.Stmt
 var stmtUntagged, stmtDeleteHonk, stmtDeleteAttachments, stmtDeleteHashtags, stmtSaveAction *sql.Stmt
 var stmtGetActions, stmtRecentAuthors *sql.Stmt
@@ -1082,8 +1065,18 @@ var stmtHonksForUserFirstClass *sql.Stmt
 var stmtSaveMeta, stmtDeleteAllMeta, stmtDeleteOneMeta, stmtDeleteSomeMeta, stmtUpdateHonk *sql.Stmt
 var stmtHonksISaved, stmtGetFilters, stmtSaveFilter, stmtDeleteFilter *sql.Stmt
 var stmtGetTracks *sql.Stmt
+var stmtSaveSearch, stmtDeleteSearch, stmtHonkFileDescs *sql.Stmt
+var stmtGetRetentionRules, stmtSaveRetentionRule, stmtDeleteRetentionRule, stmtSaveRetentionRun, stmtGetRetentionRuns *sql.Stmt
 var stmtSaveChatMessage, stmtLoadChatMessages, stmtGetChats *sql.Stmt
 var stmtGetTopDubbed *sql.Stmt
+var stmtGetDomainPolicies, stmtGetDomainPolicy, stmtSaveDomainPolicy, stmtDeleteDomainPolicy *sql.Stmt
+var stmtGetRefusals, stmtSaveRefusal, stmtUpdateRefusal, stmtDeleteRefusal *sql.Stmt
+var stmtGetDrafts, stmtGetDraft, stmtSaveDraft, stmtUpdateDraft, stmtDeleteDraft *sql.Stmt
+var stmtGetCollections, stmtGetCollection, stmtSaveCollection, stmtUpdateCollection, stmtDeleteCollection *sql.Stmt
+var stmtClearCollection, stmtCollectHonk, stmtUncollectHonk, stmtHonksByCollection *sql.Stmt
+var stmtGetFilterStats, stmtSaveFilterStats, stmtDeleteFilterStats *sql.Stmt
+var stmtGetFilterSubs, stmtGetFilterSubscribers, stmtSaveFilterSub, stmtDeleteFilterSub, stmtGetFilterPublishers *sql.Stmt
+var stmtSharesFilters *sql.Stmt
 
 var stmtActorSetBoxes, stmtActorHasBoxes, stmtActorGetBoxes, stmtActorDeleteBoxes *sql.Stmt
 var stmtActorSetPubkey, stmtActorGetPubkey, stmtActorDeleteOldPubkey, stmtDeleteOldPubkeys *sql.Stmt
@@ -1117,18 +1110,18 @@ func prepareStatements(db *sql.DB) {
 	stmtOneShare = sqlMustPrepare(db, selecthonks+"where honks.userid = ? and xid = ? and what = 'share' and whofore = 2")
 	stmtPublicHonks = sqlMustPrepare(db, selecthonks+"where whofore = 2 and dt > ?"+smalllimit)
 	stmtEventHonks = sqlMustPrepare(db, selecthonks+"where (whofore = 2 or honks.userid = ?) and what = 'event'"+smalllimit)
-	stmtUserHonks = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and (whofore = 2 or whofore = ?) and username = ? and dt > ?"+smalllimit)
+	stmtUserHonks = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and (whofore = 2 or whofore = ?) and username = ? and dt > ?"+smalllimit)
 	myAuthors := " and author in (select xid from authors where userid = ? and (flavor = 'sub' or flavor = 'peep' or flavor = 'presub') and combos not like '% - %')"
-	stmtHonksForUser = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.userid = ? and dt > ?"+myAuthors+butnotthose+limit)
-	stmtHonksForUserFirstClass = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.userid = ? and dt > ? and (what <> 'tonk')"+myAuthors+butnotthose+limit)
-	stmtHonksForMe = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.userid = ? and dt > ? and whofore = 1"+butnotthose+limit)
-	stmtHonksFromLongAgo = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.userid = ? and dt > ? and dt < ? and whofore = 2"+butnotthose+limit)
-	stmtHonksISaved = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.userid = ? and flags & 4 order by honks.honkid desc")
-	stmtHonksByAuthor = sqlMustPrepare(db, selecthonks+"join authors on (authors.xid = honks.author or authors.xid = honks.oonker) where honks.honkid > ? and honks.userid = ? and authors.name = ?"+butnotthose+limit)
-	stmtHonksByXonker = sqlMustPrepare(db, selecthonks+" where honks.honkid > ? and honks.userid = ? and (author = ? or oonker = ?)"+butnotthose+limit)
-	stmtHonksByCombo = sqlMustPrepare(db, selecthonks+" where honks.honkid > ? and honks.userid = ? and honks.author in (select xid from authors where authors.userid = ? and authors.combos like ?) "+butnotthose+" union "+selecthonks+"join hashtags on honks.honkid = hashtags.honkid where honks.honkid > ? and honks.userid = ? and hashtags.hashtag in (select xid from authors where combos like ?)"+butnotthose+limit)
-	stmtHonksByThread = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and (honks.userid = ? or (? = -1 and whofore = 2)) and thread = ?"+limit)
-	stmtHonksByHashtag = sqlMustPrepare(db, selecthonks+"join hashtags on honks.honkid = hashtags.honkid where honks.honkid > ? and hashtags.hashtag = ? and (honks.userid = ? or (? = -1 and honks.whofore = 2))"+limit)
+	stmtHonksForUser = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and dt > ?"+myAuthors+butnotthose+limit)
+	stmtHonksForUserFirstClass = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and dt > ? and (what <> 'tonk')"+myAuthors+butnotthose+limit)
+	stmtHonksForMe = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and dt > ? and whofore = 1"+butnotthose+limit)
+	stmtHonksFromLongAgo = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and dt > ? and dt < ? and whofore = 2"+butnotthose+limit)
+	stmtHonksISaved = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and honks.honkid in (select honkid from collected where collectionid = (select collectionid from collections where userid = honks.userid and name = ?)) order by honks.honkid desc")
+	stmtHonksByAuthor = sqlMustPrepare(db, selecthonks+"join authors on (authors.xid = honks.author or authors.xid = honks.oonker) where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and authors.name = ?"+butnotthose+limit)
+	stmtHonksByXonker = sqlMustPrepare(db, selecthonks+" where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and (author = ? or oonker = ?)"+butnotthose+limit)
+	stmtHonksByCombo = sqlMustPrepare(db, selecthonks+" where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and honks.author in (select xid from authors where authors.userid = ? and authors.combos like ?) "+butnotthose+" union "+selecthonks+"join hashtags on honks.honkid = hashtags.honkid where honks.honkid > ? and honks.honkid < ? and honks.userid = ? and hashtags.tag in (select xid from authors where combos like ?)"+butnotthose+limit)
+	stmtHonksByThread = sqlMustPrepare(db, selecthonks+"where honks.honkid > ? and honks.honkid < ? and (honks.userid = ? or (? = -1 and whofore = 2)) and thread = ?"+limit)
+	stmtHonksByHashtag = sqlMustPrepare(db, selecthonks+"join hashtags on honks.honkid = hashtags.honkid where honks.honkid > ? and honks.honkid < ? and hashtags.tag = ? and (honks.userid = ? or (? = -1 and honks.whofore = 2))"+limit)
 
 	stmtSaveMeta = sqlMustPrepare(db, "insert into honkmeta (honkid, genus, json) values (?, ?, ?)")
 	stmtDeleteAllMeta = sqlMustPrepare(db, "delete from honkmeta where honkid = ?")
@@ -1137,17 +1130,25 @@ func prepareStatements(db *sql.DB) {
 	stmtSaveHonk = sqlMustPrepare(db, "insert into honks (userid, what, author, xid, inReplyToID, dt, url, audience, text, thread, whofore, format, precis, oonker, flags) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
 	stmtDeleteHonk = sqlMustPrepare(db, "delete from honks where honkid = ?")
 	stmtUpdateHonk = sqlMustPrepare(db, "update honks set precis = ?, text = ?, format = ?, whofore = ?, dt = ? where honkid = ?")
-	stmtSaveHashtag = sqlMustPrepare(db, "insert into hashtags (hashtag, honkid) values (?, ?)")
+	stmtSaveHashtag = sqlMustPrepare(db, "insert into hashtags (tag, honkid) values (?, ?)")
 	stmtDeleteHashtags = sqlMustPrepare(db, "delete from hashtags where honkid = ?")
 	stmtSaveAttachment = sqlMustPrepare(db, "insert into attachments (honkid, chatMessageId, fileid) values (?, ?, ?)")
 	stmtDeleteAttachments = sqlMustPrepare(db, "delete from attachments where honkid = ?")
-	stmtSaveFile = sqlMustPrepare(db, "insert into filemeta (xid, name, description, url, media, local) values (?, ?, ?, ?, ?, ?)")
-	blobdb := openblobdb()
-	stmtSaveFileData = sqlMustPrepare(blobdb, "insert into filedata (xid, media, hash, content) values (?, ?, ?, ?)")
-	stmtCheckFileData = sqlMustPrepare(blobdb, "select xid from filedata where hash = ?")
-	stmtGetFileData = sqlMustPrepare(blobdb, "select media, content from filedata where xid = ?")
+	stmtSaveFile = sqlMustPrepare(db, "insert into filemeta (xid, name, description, url, media, local, blurhash, width, height, duration, dt) values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	stmtUpdateFileDesc = sqlMustPrepare(db, "update filemeta set description = ? where fileid = ?")
+	stmtFileSharers = sqlMustPrepare(db, "select count(*) from attachments where fileid = ? and honkid != ?")
+	stmtCopyFile = sqlMustPrepare(db, "insert into filemeta (xid, name, description, url, media, local, blurhash, width, height, duration, dt) select xid, name, ?, url, media, local, blurhash, width, height, duration, dt from filemeta where fileid = ?")
+	stmtRepointAttachment = sqlMustPrepare(db, "update attachments set fileid = ? where honkid = ? and fileid = ?")
+	var err error
+	mediaStore, err = openmediastore(mediaStoreName, openblobdb())
+	if err != nil {
+		elog.Fatal(err)
+	}
 	stmtFindXonk = sqlMustPrepare(db, "select honkid from honks where userid = ? and xid = ?")
-	stmtFindFile = sqlMustPrepare(db, "select fileid, xid from filemeta where url = ? and local = 1")
+	stmtFindFile = sqlMustPrepare(db, "select fileid, xid, name, description, url, media from filemeta where url = ? and local = 1")
+	stmtFindRemoteFile = sqlMustPrepare(db, "select fileid from filemeta where url = ? and local = 0 limit 1")
+	stmtProxyFile = sqlMustPrepare(db, "select url, media from filemeta where fileid = ? and local = 0")
+	stmtProxyAllowed = sqlMustPrepare(db, "select 1 from attachments where fileid = ? and (honkid in (select honkid from honks where userid = ?) or chatMessageId in (select chatMessageId from chatMessages where userid = ?)) limit 1")
 	stmtUserByName = sqlMustPrepare(db, "select userid, username, displayname, about, pubkey, seckey, options from users where username = ?")
 	stmtUserByNumber = sqlMustPrepare(db, "select userid, username, displayname, about, pubkey, seckey, options from users where userid = ?")
 	stmtSaveDub = sqlMustPrepare(db, "insert into authors (userid, name, xid, flavor, combos, owner, meta, folxid) values (?, ?, ?, ?, '', '', '', ?)")
@@ -1162,15 +1163,55 @@ func prepareStatements(db *sql.DB) {
 	stmtRecentAuthors = sqlMustPrepare(db, "select distinct(author) from honks where userid = ? and author not in (select xid from authors where userid = ? and flavor = 'sub') order by honkid desc limit 100")
 	stmtUpdateFlags = sqlMustPrepare(db, "update honks set flags = flags | ? where honkid = ?")
 	stmtClearFlags = sqlMustPrepare(db, "update honks set flags = flags & ~ ? where honkid = ?")
-	stmtAllHashtags = sqlMustPrepare(db, "select hashtag, count(hashtag) from hashtags join honks on hashtags.honkid = honks.honkid where (honks.userid = ? or honks.whofore = 2) group by hashtag")
+	stmtAllHashtags = sqlMustPrepare(db, "select tag, count(tag) from hashtags join honks on hashtags.honkid = honks.honkid where (honks.userid = ? or honks.whofore = 2) group by tag")
 	stmtGetFilters = sqlMustPrepare(db, "select hfcsid, json from hfcs where userid = ?")
 	stmtSaveFilter = sqlMustPrepare(db, "insert into hfcs (userid, json) values (?, ?)")
 	stmtDeleteFilter = sqlMustPrepare(db, "delete from hfcs where userid = ? and hfcsid = ?")
+	stmtGetFilterStats = sqlMustPrepare(db, "select hfcsid, hits, dt, samples from filterstats")
+	stmtSaveFilterStats = sqlMustPrepare(db, "insert or replace into filterstats (hfcsid, hits, dt, samples) values (?, ?, ?, ?)")
+	stmtDeleteFilterStats = sqlMustPrepare(db, "delete from filterstats where hfcsid = ?")
+	stmtGetFilterSubs = sqlMustPrepare(db, "select owner from filtersubs where userid = ?")
+	stmtGetFilterSubscribers = sqlMustPrepare(db, "select userid from filtersubs where owner = ?")
+	stmtSaveFilterSub = sqlMustPrepare(db, "insert into filtersubs (userid, owner) values (?, ?)")
+	stmtDeleteFilterSub = sqlMustPrepare(db, "delete from filtersubs where userid = ? and owner = ?")
+	stmtSharesFilters = sqlMustPrepare(db, "select 1 from hfcs where userid = ? and json_extract(json, '$.Shared') limit 1")
+	stmtGetFilterPublishers = sqlMustPrepare(db, `select userid, username, exists (select 1 from hfcs where hfcs.userid = users.userid and json_extract(json, '$.Shared')) as shared from users where userid <> ? and (shared or userid in (select owner from filtersubs where userid = ?)) order by username`)
+	stmtSaveSearch = sqlMustPrepare(db, "insert into honksearch (rowid, text, precis, descs) values (?, ?, ?, ?)")
+	stmtDeleteSearch = sqlMustPrepare(db, "delete from honksearch where rowid = ?")
+	stmtHonkFileDescs = sqlMustPrepare(db, "select description from filemeta join attachments on filemeta.fileid = attachments.fileid where attachments.honkid = ?")
+	stmtGetRetentionRules = sqlMustPrepare(db, "select ruleid, what, days, author, keep, dt from retention order by ruleid")
+	stmtSaveRetentionRule = sqlMustPrepare(db, "insert into retention (what, days, author, keep, dt) values (?, ?, ?, ?, ?)")
+	stmtDeleteRetentionRule = sqlMustPrepare(db, "delete from retention where ruleid = ?")
+	stmtSaveRetentionRun = sqlMustPrepare(db, "insert into retentionruns (dt, honks, files, blobs, details) values (?, ?, ?, ?, ?)")
+	stmtGetRetentionRuns = sqlMustPrepare(db, "select dt, honks, files, blobs, details from retentionruns order by runid desc limit ?")
 	stmtGetTracks = sqlMustPrepare(db, "select fetches from tracks where xid = ?")
 	stmtSaveChatMessage = sqlMustPrepare(db, "insert into chatMessages (userid, xid, who, target, dt, text, format) values (?, ?, ?, ?, ?, ?, ?)")
 	stmtLoadChatMessages = sqlMustPrepare(db, "select chatMessageId, userid, xid, who, target, dt, text, format from chatMessages where userid = ? and dt > ? order by chatMessageId asc")
 	stmtGetChats = sqlMustPrepare(db, "select distinct(target) from chatMessages where userid = ?")
 	stmtGetTopDubbed = sqlMustPrepare(db, `SELECT COUNT(*) as c,userid FROM authors WHERE flavor = "dub" GROUP BY userid`)
+	stmtGetDomainPolicies = sqlMustPrepare(db, "select host, actions, notes, dt from domainpolicy order by host")
+	stmtGetDomainPolicy = sqlMustPrepare(db, "select actions from domainpolicy where host = ?")
+	stmtSaveDomainPolicy = sqlMustPrepare(db, "insert or replace into domainpolicy (host, actions, notes, dt) values (?, ?, ?, ?)")
+	stmtDeleteDomainPolicy = sqlMustPrepare(db, "delete from domainpolicy where host = ?")
+	stmtGetRefusals = sqlMustPrepare(db, "select host, what, hits, dt from refusals order by dt desc")
+	stmtSaveRefusal = sqlMustPrepare(db, "insert into refusals (host, what, hits, dt) values (?, ?, 1, ?)")
+	stmtUpdateRefusal = sqlMustPrepare(db, "update refusals set what = ?, hits = hits + 1, dt = ? where host = ?")
+	stmtDeleteRefusal = sqlMustPrepare(db, "delete from refusals where host = ?")
+	stmtGetDrafts = sqlMustPrepare(db, "select draftid, userid, dt, json from drafts where userid = ? order by dt desc")
+	stmtGetDraft = sqlMustPrepare(db, "select draftid, userid, dt, json from drafts where draftid = ? and userid = ?")
+	stmtSaveDraft = sqlMustPrepare(db, "insert into drafts (userid, dt, json) values (?, ?, ?)")
+	stmtUpdateDraft = sqlMustPrepare(db, "update drafts set dt = ?, json = ? where draftid = ? and userid = ?")
+	stmtDeleteDraft = sqlMustPrepare(db, "delete from drafts where draftid = ? and userid = ?")
+	selectcollections := "select collectionid, userid, name, notes, dt, (select count(*) from collected where collected.collectionid = collections.collectionid) from collections "
+	stmtGetCollections = sqlMustPrepare(db, selectcollections+"where userid = ? order by name")
+	stmtGetCollection = sqlMustPrepare(db, selectcollections+"where userid = ? and name = ?")
+	stmtSaveCollection = sqlMustPrepare(db, "insert into collections (userid, name, notes, dt) values (?, ?, ?, ?)")
+	stmtUpdateCollection = sqlMustPrepare(db, "update collections set name = ?, notes = ? where collectionid = ? and userid = ?")
+	stmtDeleteCollection = sqlMustPrepare(db, "delete from collections where collectionid = ? and userid = ?")
+	stmtClearCollection = sqlMustPrepare(db, "delete from collected where collectionid = ?")
+	stmtCollectHonk = sqlMustPrepare(db, "insert into collected (collectionid, honkid, added) select ?, ?, ? where not exists (select 1 from collected where collectionid = ? and honkid = ?)")
+	stmtUncollectHonk = sqlMustPrepare(db, "delete from collected where collectionid = ? and honkid = ?")
+	stmtHonksByCollection = sqlMustPrepare(db, selecthonks+"join collected on honks.honkid = collected.honkid where collected.collectionid = ? and honks.userid = ? order by collected.added desc")
 
 	stmtActorSetBoxes = sqlMustPrepare(db, "insert into actorBoxes (ident, inbox, outbox, sharedInbox) values (?, ?, ?, ?)")
 	stmtActorHasBoxes = sqlMustPrepare(db, "select COUNT(*) from actorBoxes where ident = ?")
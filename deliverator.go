@@ -86,6 +86,9 @@ func deliverate(retries int64, userid int64, rcpt string, msg []byte, prio bool)
 	if rcpt[0] == '%' {
 		inbox = rcpt[1:]
 	} else {
+		if policyNoDeliver(rcpt) {
+			return
+		}
 		var box *Box
 		ok := boxofboxes.Get(rcpt, &box)
 		if !ok {
@@ -95,6 +98,9 @@ func deliverate(retries int64, userid int64, rcpt string, msg []byte, prio bool)
 		}
 		inbox = box.In
 	}
+	if policyNoDeliver(inbox) {
+		return
+	}
 	err := PostMsg(ki.keyname, ki.seckey, inbox, msg)
 	if err != nil {
 		ilog.Printf("failed to post json to %s: %s", inbox, err)
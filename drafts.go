@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Draft is a honk not yet posted, kept as the compose form had it.
+type Draft struct {
+	ID          int64     `json:"-"`
+	UserID      int64     `json:"-"`
+	Date        time.Time `json:"-"`
+	Text        string
+	Precis      string   `json:",omitempty"`
+	InReplyToID string   `json:",omitempty"`
+	Attachments []string `json:",omitempty"`
+	Place       *Place   `json:",omitempty"`
+	StartTime   string   `json:",omitempty"`
+	Duration    string   `json:",omitempty"`
+}
+
+// draftprecis is the summary line, as translate would find it
+func draftprecis(text string) string {
+	if !strings.HasPrefix(text, "DZ:") {
+		return ""
+	}
+	if idx := strings.IndexByte(text, '\n'); idx != -1 {
+		text = text[:idx]
+	}
+	return strings.TrimSpace(text)
+}
+
+func scandraft(row interface{ Scan(...interface{}) error }) *Draft {
+	d := new(Draft)
+	var dt, j string
+	err := row.Scan(&d.ID, &d.UserID, &dt, &j)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			elog.Printf("error scanning draft: %s", err)
+		}
+		return nil
+	}
+	d.Date, _ = time.Parse(dbtimeformat, dt)
+	err = json.Unmarshal([]byte(j), d)
+	if err != nil {
+		elog.Printf("error decoding draft: %s", err)
+	}
+	return d
+}
+
+func getDrafts(userid int64) []*Draft {
+	rows, err := stmtGetDrafts.Query(userid)
+	if err != nil {
+		elog.Printf("error querying drafts: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var drafts []*Draft
+	for rows.Next() {
+		if d := scandraft(rows); d != nil {
+			drafts = append(drafts, d)
+		}
+	}
+	return drafts
+}
+
+func getDraft(userid int64, draftid int64) *Draft {
+	row := stmtGetDraft.QueryRow(draftid, userid)
+	return scandraft(row)
+}
+
+var errDraftGone = errors.New("draft is gone")
+
+// saveDraft saves a new draft, or replaces the one with the same ID.
+// Once a draft is posted or deleted, late saves don't bring it back.
+func saveDraft(d *Draft) error {
+	j, err := encodeJson(d)
+	if err != nil {
+		return err
+	}
+	dt := d.Date.UTC().Format(dbtimeformat)
+	if d.ID != 0 {
+		res, err := stmtUpdateDraft.Exec(dt, j, d.ID, d.UserID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errDraftGone
+		}
+		return nil
+	}
+	res, err := stmtSaveDraft.Exec(d.UserID, dt, j)
+	if err != nil {
+		return err
+	}
+	d.ID, _ = res.LastInsertId()
+	return nil
+}
+
+func deleteDraft(userid int64, draftid int64) error {
+	_, err := stmtDeleteDraft.Exec(draftid, userid)
+	return err
+}
+
+// draftfiles are attachments only a draft knows about
+func draftfiles(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query("select draftid, userid, dt, json from drafts")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	xids := make(map[string]bool)
+	for rows.Next() {
+		d := scandraft(rows)
+		if d == nil {
+			continue
+		}
+		for _, xid := range d.Attachments {
+			xids[xid] = true
+		}
+	}
+	return xids, rows.Err()
+}
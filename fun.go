@@ -16,10 +16,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
+	"encoding/base64"
 	"fmt"
 	"html/template"
+	"image/png"
 	"io"
 	"net/http"
 	"net/url"
@@ -28,6 +31,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/benjojo/honk-benjojo/image"
 	"golang.org/x/net/html"
 	"humungus.tedunangst.com/r/webs/cache"
 	"humungus.tedunangst.com/r/webs/htfilter"
@@ -186,6 +190,27 @@ func reverbolate(userid int64, honks []*ActivityPubActivity) {
 	}
 }
 
+// cleanhtml is the first pass over remote html, keeping images
+// as plain tags for imaginate and reverbolate to deal with later.
+func cleanhtml(text string, baseurl string) string {
+	var htf htfilter.Filter
+	htf.SpanClasses = allowedclasses
+	htf.BaseURL, _ = url.Parse(baseurl)
+	htf.Imager = func(node *html.Node) string {
+		src := htfilter.GetAttr(node, "src")
+		alt := htfilter.GetAttr(node, "alt")
+		if u, err := url.Parse(src); err == nil && htf.BaseURL != nil {
+			src = htf.BaseURL.ResolveReference(u).String()
+		}
+		if htfilter.HasClass(node, "Emoji") {
+			return string(templates.Sprintf(`<img class="Emoji" alt="%s" src="%s">`, alt, src))
+		}
+		return string(templates.Sprintf(`<img alt="%s" src="%s">`, alt, src))
+	}
+	h, _ := htf.String(text)
+	return strings.TrimRight(string(h), "\n")
+}
+
 func replaceimgsand(zap map[string]bool, absolute bool) func(node *html.Node) string {
 	return func(node *html.Node) string {
 		src := htfilter.GetAttr(node, "src")
@@ -203,6 +228,11 @@ func replaceimgsand(zap map[string]bool, absolute bool) func(node *html.Node) st
 			}
 			return string(templates.Sprintf(`<img alt="%s" title="%s" src="%s/d/%s">`, alt, alt, base, d.XID))
 		}
+		if !absolute {
+			if fileid := findRemoteFile(src); fileid != 0 {
+				return string(templates.Sprintf(`<img alt="%s" title="%s" src="%s">`, alt, alt, proxyurl(fileid)))
+			}
+		}
 		return string(templates.Sprintf(`&lt;img alt="%s" src="<a href="%s">%s</a>"&gt;`, alt, src, src))
 	}
 }
@@ -268,7 +298,7 @@ func inlineimgsfor(honk *ActivityPubActivity) func(node *html.Node) string {
 	return func(node *html.Node) string {
 		src := htfilter.GetAttr(node, "src")
 		alt := htfilter.GetAttr(node, "alt")
-		d := saveAttachment(src, "image", alt, "image", true)
+		d := saveAttachment(src, "image", alt, "image", nil, true)
 		if d != nil {
 			honk.Attachments = append(honk.Attachments, d)
 		}
@@ -277,6 +307,59 @@ func inlineimgsfor(honk *ActivityPubActivity) func(node *html.Node) string {
 	}
 }
 
+var blurplaceholders = cache.New(cache.Options{Filler: func(blurhash string) (template.CSS, bool) {
+	img, err := image.BlurhashImage(blurhash, 32, 32)
+	if err != nil {
+		dlog.Printf("bad blurhash %s: %s", blurhash, err)
+		return "", true
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	css := "background-image: url(data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(buf.Bytes()) + "); background-size: 100% 100%;"
+	return template.CSS(css), true
+}, Limit: 512})
+
+// Placeholder is the blurred image shown until the real one loads
+func (d *Attachment) Placeholder() template.CSS {
+	var css template.CSS
+	if d.Blurhash != "" {
+		blurplaceholders.Get(d.Blurhash, &css)
+	}
+	return css
+}
+
+// Srcset lists the smaller renditions of a local image, if any were made
+func (d *Attachment) Srcset() string {
+	if !d.Local || d.Width == 0 || d.Height == 0 || d.Media == "image/gif" {
+		return ""
+	}
+	longest := d.Width
+	if d.Height > longest {
+		longest = d.Height
+	}
+	var srcs []string
+	for _, r := range renditions {
+		if longest <= r.size {
+			continue
+		}
+		srcs = append(srcs, fmt.Sprintf("/d/%s?size=%s %dw", d.XID, r.name, d.Width*r.size/longest))
+	}
+	if len(srcs) == 0 {
+		return ""
+	}
+	srcs = append(srcs, fmt.Sprintf("/d/%s %dw", d.XID, d.Width))
+	return strings.Join(srcs, ", ")
+}
+
+func (d *Attachment) IsVideo() bool {
+	return strings.HasPrefix(d.Media, "video/")
+}
+
+func (d *Attachment) IsAudio() bool {
+	return strings.HasPrefix(d.Media, "audio/")
+}
+
 func imaginate(honk *ActivityPubActivity) {
 	var htf htfilter.Filter
 	htf.Imager = inlineimgsfor(honk)
@@ -433,7 +516,7 @@ func memetize(honk *ActivityPubActivity) {
 		fd.Close()
 
 		url := fmt.Sprintf("https://%s/meme/%s", serverName, name)
-		fileID, err := saveFileMetadata("", name, name, url, ct)
+		fileID, err := saveFileMetadata("", name, name, url, ct, nil)
 		if err != nil {
 			elog.Printf("error saving meme: %s", err)
 			return x
@@ -640,7 +723,7 @@ var zaggies = cache.New(cache.Options{Filler: func(keyname string) (httpsig.Publ
 	stmtActorGetPubkey.QueryRow(keyname).Scan(&data)
 	if data == "" {
 		dlog.Printf("hitting the webs for missing pubkey: %s", keyname)
-		j, err := getAndParseLongTimeout(serverUID, keyname)
+		j, err := getAndParseKey(keyname)
 		if err != nil {
 			ilog.Printf("error getting %s pubkey: %s", keyname, err)
 			when := time.Now().UTC().Format(dbtimeformat)
@@ -16,10 +16,17 @@
 package main
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"regexp"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"humungus.tedunangst.com/r/webs/cache"
@@ -42,9 +49,35 @@ type Filter struct {
 	Collapse        bool   `json:",omitempty"`
 	Rewrite         string `json:",omitempty"`
 	re_rewrite      *regexp.Regexp
-	Replace         string `json:",omitempty"`
+	Replace         string    `json:",omitempty"`
+	Hashtag         string    `json:",omitempty"`
+	Media           string    `json:",omitempty"`
+	Lang            string    `json:",omitempty"`
+	MinMentions     int       `json:",omitempty"`
+	IsReply         bool      `json:",omitempty"`
+	IsTopLevel      bool      `json:",omitempty"`
+	Cond            *FiltCond `json:",omitempty"`
 	Expiration      time.Time
 	Notes           string
+	Shared          bool   `json:",omitempty"`
+	Owner           string `json:"-"`
+}
+
+// FiltCond is either a combination of sub conditions (and, or, not)
+// or a single test. All tests in one FiltCond must match.
+type FiltCond struct {
+	Op          string      `json:",omitempty"`
+	Sub         []*FiltCond `json:",omitempty"`
+	Actor       string      `json:",omitempty"`
+	Text        string      `json:",omitempty"`
+	re_text     *regexp.Regexp
+	Hashtag     string `json:",omitempty"`
+	Media       string `json:",omitempty"`
+	Lang        string `json:",omitempty"`
+	MinMentions int    `json:",omitempty"`
+	IsReply     bool   `json:",omitempty"`
+	IsTopLevel  bool   `json:",omitempty"`
+	IsAnnounce  bool   `json:",omitempty"`
 }
 
 type filtType uint
@@ -76,18 +109,158 @@ func init() {
 }
 
 func filtcachefiller(userid int64) (afiltermap, bool) {
-	rows, err := stmtGetFilters.Query(userid)
+	now := time.Now()
+
+	var expflush time.Time
+
+	filts, err := loadfilters(userid, now, &expflush)
 	if err != nil {
 		elog.Printf("error querying filters: %s", err)
 		return nil, false
 	}
-	defer rows.Close()
+	for _, sub := range getfiltersubs(userid) {
+		var owner *UserProfile
+		if !usersCacheByID.Get(sub, &owner) {
+			continue
+		}
+		subfilts, err := loadfilters(sub, now, &expflush)
+		if err != nil {
+			elog.Printf("error querying subscribed filters: %s", err)
+			continue
+		}
+		for _, filt := range subfilts {
+			if filt.Shared {
+				filt.Owner = owner.Name
+				filts = append(filts, filt)
+			}
+		}
+	}
 
-	now := time.Now()
+	filtmap := make(afiltermap)
+	for _, filt := range filts {
+		for _, a := range filt.Actions {
+			filtmap[a] = append(filtmap[a], filt)
+		}
+		filtmap[filtAny] = append(filtmap[filtAny], filt)
+	}
+	sorting := filtmap[filtAny]
+	sort.Slice(filtmap[filtAny], func(i, j int) bool {
+		return sorting[i].Name < sorting[j].Name
+	})
+	if !expflush.IsZero() {
+		dur := expflush.Sub(now)
+		go filtcacheclear(userid, dur)
+	}
+	return filtmap, true
+}
 
-	var expflush time.Time
+func filtregexp(t string) (*regexp.Regexp, error) {
+	wordfront := t[0] != '#'
+	wordtail := true
+	t = "(?i:" + t + ")"
+	if wordfront {
+		t = "\\b" + t
+	}
+	if wordtail {
+		t = t + "\\b"
+	}
+	return regexp.Compile(t)
+}
 
-	filtmap := make(afiltermap)
+// compile prepares the regexps and fills in Actions
+func (filt *Filter) compile() error {
+	var err error
+	if t := filt.Text; t != "" {
+		filt.re_text, err = filtregexp(t)
+		if err != nil {
+			return fmt.Errorf("text: %s", err)
+		}
+	}
+	if t := filt.Rewrite; t != "" {
+		filt.re_rewrite, err = filtregexp(t)
+		if err != nil {
+			return fmt.Errorf("rewrite: %s", err)
+		}
+	}
+	if filt.Cond != nil {
+		err = filt.Cond.compile()
+		if err != nil {
+			return fmt.Errorf("condition: %s", err)
+		}
+	}
+	filt.Actions = nil
+	if filt.Reject {
+		filt.Actions = append(filt.Actions, filtReject)
+	}
+	if filt.SkipMedia {
+		filt.Actions = append(filt.Actions, filtSkipMedia)
+	}
+	if filt.Hide {
+		filt.Actions = append(filt.Actions, filtHide)
+	}
+	if filt.Collapse {
+		filt.Actions = append(filt.Actions, filtCollapse)
+	}
+	if filt.Rewrite != "" {
+		filt.Actions = append(filt.Actions, filtRewrite)
+	}
+	return nil
+}
+
+func (fc *FiltCond) compile() error {
+	var err error
+	if t := fc.Text; t != "" {
+		fc.re_text, err = filtregexp(t)
+		if err != nil {
+			return err
+		}
+	}
+	for _, sub := range fc.Sub {
+		err = sub.compile()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extra conditions beyond the classic actor and text
+func (filt *Filter) hasExtras() bool {
+	return filt.Hashtag != "" || filt.Media != "" || filt.Lang != "" ||
+		filt.MinMentions > 0 || filt.IsReply || filt.IsTopLevel || filt.Cond != nil
+}
+
+// needsParsed is true if the filter looks at replies, hashtags, attachments,
+// or mentions, which aren't known until the whole object is parsed.
+func (filt *Filter) needsParsed() bool {
+	return filt.Hashtag != "" || filt.Media != "" || filt.MinMentions > 0 ||
+		filt.IsReply || filt.IsTopLevel || filt.Cond.needsParsed()
+}
+
+func (fc *FiltCond) needsParsed() bool {
+	if fc == nil {
+		return false
+	}
+	if fc.Hashtag != "" || fc.Media != "" || fc.MinMentions > 0 ||
+		fc.IsReply || fc.IsTopLevel {
+		return true
+	}
+	for _, sub := range fc.Sub {
+		if sub.needsParsed() {
+			return true
+		}
+	}
+	return false
+}
+
+func loadfilters(userid int64, now time.Time, expflush *time.Time) ([]*Filter, error) {
+	rows, err := stmtGetFilters.Query(userid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var filts []*Filter
 	for rows.Next() {
 		filt := new(Filter)
 		var j string
@@ -104,74 +277,103 @@ func filtcachefiller(userid int64) (afiltermap, bool) {
 			if filt.Expiration.Before(now) {
 				continue
 			}
-			if expflush.IsZero() || filt.Expiration.Before(expflush) {
-				expflush = filt.Expiration
+			if expflush.IsZero() || filt.Expiration.Before(*expflush) {
+				*expflush = filt.Expiration
 			}
 		}
-		if t := filt.Text; t != "" {
-			wordfront := t[0] != '#'
-			wordtail := true
-			t = "(?i:" + t + ")"
-			if wordfront {
-				t = "\\b" + t
-			}
-			if wordtail {
-				t = t + "\\b"
-			}
-			filt.re_text, err = regexp.Compile(t)
-			if err != nil {
-				elog.Printf("error compiling filter text: %s", err)
-				continue
-			}
-		}
-		if t := filt.Rewrite; t != "" {
-			wordfront := t[0] != '#'
-			wordtail := true
-			t = "(?i:" + t + ")"
-			if wordfront {
-				t = "\\b" + t
-			}
-			if wordtail {
-				t = t + "\\b"
-			}
-			filt.re_rewrite, err = regexp.Compile(t)
-			if err != nil {
-				elog.Printf("error compiling filter rewrite: %s", err)
-				continue
-			}
+		err = filt.compile()
+		if err != nil {
+			elog.Printf("error compiling filter: %s", err)
+			continue
 		}
 		filt.ID = filterid
-		if filt.Reject {
-			filt.Actions = append(filt.Actions, filtReject)
-			filtmap[filtReject] = append(filtmap[filtReject], filt)
-		}
-		if filt.SkipMedia {
-			filt.Actions = append(filt.Actions, filtSkipMedia)
-			filtmap[filtSkipMedia] = append(filtmap[filtSkipMedia], filt)
-		}
-		if filt.Hide {
-			filt.Actions = append(filt.Actions, filtHide)
-			filtmap[filtHide] = append(filtmap[filtHide], filt)
-		}
-		if filt.Collapse {
-			filt.Actions = append(filt.Actions, filtCollapse)
-			filtmap[filtCollapse] = append(filtmap[filtCollapse], filt)
+		filts = append(filts, filt)
+	}
+	return filts, nil
+}
+
+func getfiltersubs(userid int64) []int64 {
+	rows, err := stmtGetFilterSubs.Query(userid)
+	if err != nil {
+		elog.Printf("error querying filter subscriptions: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var owners []int64
+	for rows.Next() {
+		var owner int64
+		err = rows.Scan(&owner)
+		if err != nil {
+			elog.Printf("error scanning filter subscription: %s", err)
+			continue
 		}
-		if filt.Rewrite != "" {
-			filt.Actions = append(filt.Actions, filtRewrite)
-			filtmap[filtRewrite] = append(filtmap[filtRewrite], filt)
+		owners = append(owners, owner)
+	}
+	return owners
+}
+
+// filtersChanged clears the cache for the user and anyone subscribed
+func filtersChanged(userid int64) {
+	filtInvalidator.Clear(userid)
+	rows, err := stmtGetFilterSubscribers.Query(userid)
+	if err != nil {
+		elog.Printf("error querying filter subscribers: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var sub int64
+		err = rows.Scan(&sub)
+		if err != nil {
+			elog.Printf("error scanning filter subscriber: %s", err)
+			continue
 		}
-		filtmap[filtAny] = append(filtmap[filtAny], filt)
+		filtInvalidator.Clear(sub)
 	}
-	sorting := filtmap[filtAny]
-	sort.Slice(filtmap[filtAny], func(i, j int) bool {
-		return sorting[i].Name < sorting[j].Name
-	})
-	if !expflush.IsZero() {
-		dur := expflush.Sub(now)
-		go filtcacheclear(userid, dur)
+}
+
+// FilterPublisher is a local user sharing filters, or one the user
+// is still subscribed to after they stopped sharing.
+type FilterPublisher struct {
+	ID         int64
+	Name       string
+	Shared     bool
+	Subscribed bool
+}
+
+// sharesfilters is true if the user shares any filters
+func sharesfilters(owner int64) bool {
+	var one int
+	err := stmtSharesFilters.QueryRow(owner).Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		elog.Printf("error checking shared filters: %s", err)
 	}
-	return filtmap, true
+	return err == nil
+}
+
+func getfilterpublishers(userid int64) []*FilterPublisher {
+	subs := make(map[int64]bool)
+	for _, sub := range getfiltersubs(userid) {
+		subs[sub] = true
+	}
+	rows, err := stmtGetFilterPublishers.Query(userid, userid)
+	if err != nil {
+		elog.Printf("error querying filter publishers: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var pubs []*FilterPublisher
+	for rows.Next() {
+		p := new(FilterPublisher)
+		err = rows.Scan(&p.ID, &p.Name, &p.Shared)
+		if err != nil {
+			elog.Printf("error scanning filter publisher: %s", err)
+			continue
+		}
+		p.Subscribed = subs[p.ID]
+		pubs = append(pubs, p)
+	}
+	return pubs
 }
 
 func filtcacheclear(userid int64, dur time.Duration) {
@@ -196,7 +398,7 @@ var rejectcache = cache.New(cache.Options{Filler: func(userid int64) (arejectmap
 	m := make(arejectmap)
 	filts := getfilters(userid, filtReject)
 	for _, f := range filts {
-		if f.Text != "" {
+		if f.Text != "" || f.hasExtras() {
 			key := rejectAnyKey
 			m[key] = append(m[key], f)
 			continue
@@ -227,10 +429,12 @@ func rejectorigin(userid int64, origin string, isannounce bool) bool {
 	for _, f := range filts {
 		if isannounce && f.IsAnnounce {
 			if f.AnnounceOf == origin {
+				filthit(f, origin)
 				return true
 			}
 		}
 		if f.Actor == origin {
+			filthit(f, origin)
 			return true
 		}
 	}
@@ -245,6 +449,7 @@ func rejectactor(userid int64, actor string) bool {
 		}
 		if f.Actor == actor {
 			ilog.Printf("rejecting actor: %s", actor)
+			filthit(f, actor)
 			return true
 		}
 	}
@@ -259,6 +464,7 @@ func rejectactor(userid int64, actor string) bool {
 		}
 		if f.Actor == origin {
 			ilog.Printf("rejecting actor: %s", actor)
+			filthit(f, actor)
 			return true
 		}
 	}
@@ -282,56 +488,132 @@ func matchfilter(h *ActivityPubActivity, f *Filter) bool {
 	return matchfilterX(h, f) != ""
 }
 
+func matchactor(h *ActivityPubActivity, actor string, incaud bool) bool {
+	if actor == h.Author || actor == h.Oonker {
+		return true
+	}
+	if actor == originate(h.Author) || actor == originate(h.Oonker) ||
+		actor == originate(h.XID) {
+		return true
+	}
+	if incaud {
+		for _, a := range h.Audience {
+			if actor == a || actor == originate(a) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchtext(h *ActivityPubActivity, re *regexp.Regexp) string {
+	m := re.FindString(h.Precis)
+	if m == "" {
+		m = re.FindString(h.Text)
+	}
+	if m == "" {
+		for _, d := range h.Attachments {
+			m = re.FindString(d.Desc)
+			if m != "" {
+				break
+			}
+		}
+	}
+	return m
+}
+
+func matchhashtag(h *ActivityPubActivity, tag string) bool {
+	if tag[0] != '#' {
+		tag = "#" + tag
+	}
+	for _, t := range h.Hashtags {
+		if strings.EqualFold(t, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// media may be a full type, image/png, or just the class, image
+func matchmedia(h *ActivityPubActivity, media string) bool {
+	for _, d := range h.Attachments {
+		if d.Media == media || strings.HasPrefix(d.Media, media+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// lang en matches en-US too
+func matchlang(h *ActivityPubActivity, lang string) bool {
+	return strings.EqualFold(h.Lang, lang) ||
+		strings.HasPrefix(strings.ToLower(h.Lang), strings.ToLower(lang)+"-")
+}
+
 func matchfilterX(h *ActivityPubActivity, f *Filter) string {
 	rv := ""
 	match := true
 	if match && f.Actor != "" {
-		match = false
-		if f.Actor == h.Author || f.Actor == h.Oonker {
-			match = true
-			rv = f.Actor
-		}
-		if !match && (f.Actor == originate(h.Author) ||
-			f.Actor == originate(h.Oonker) ||
-			f.Actor == originate(h.XID)) {
-			match = true
+		match = matchactor(h, f.Actor, f.IncludeAudience)
+		if match {
 			rv = f.Actor
 		}
-		if !match && f.IncludeAudience {
-			for _, a := range h.Audience {
-				if f.Actor == a || f.Actor == originate(a) {
-					match = true
-					rv = f.Actor
-					break
-				}
-			}
-		}
 	}
 	if match && f.IsAnnounce {
 		match = false
-		if (f.AnnounceOf == "" && h.Oonker != "") || f.AnnounceOf == h.Oonker ||
-			f.AnnounceOf == originate(h.Oonker) {
+		if h.Oonker != "" && (f.AnnounceOf == "" || f.AnnounceOf == h.Oonker ||
+			f.AnnounceOf == originate(h.Oonker)) {
 			match = true
 			rv += " announce"
 		}
 	}
 	if match && f.Text != "" {
 		match = false
-		re := f.re_text
-		m := re.FindString(h.Precis)
-		if m == "" {
-			m = re.FindString(h.Text)
+		if m := matchtext(h, f.re_text); m != "" {
+			match = true
+			rv = m
 		}
-		if m == "" {
-			for _, d := range h.Attachments {
-				m = re.FindString(d.Desc)
-				if m != "" {
-					break
-				}
-			}
+	}
+	if match && f.Hashtag != "" {
+		match = matchhashtag(h, f.Hashtag)
+		if match && rv == "" {
+			rv = f.Hashtag
 		}
-		if m != "" {
-			match = true
+	}
+	if match && f.Media != "" {
+		match = matchmedia(h, f.Media)
+		if match && rv == "" {
+			rv = f.Media
+		}
+	}
+	if match && f.Lang != "" {
+		match = matchlang(h, f.Lang)
+		if match && rv == "" {
+			rv = f.Lang
+		}
+	}
+	if match && f.MinMentions > 0 {
+		match = len(h.Mentions) >= f.MinMentions
+		if match && rv == "" {
+			rv = "mentions"
+		}
+	}
+	if match && f.IsReply {
+		match = h.InReplyToID != ""
+		if match && rv == "" {
+			rv = "reply"
+		}
+	}
+	if match && f.IsTopLevel {
+		match = h.InReplyToID == ""
+		if match && rv == "" {
+			rv = "toplevel"
+		}
+	}
+	if match && f.Cond != nil {
+		m := f.Cond.match(h)
+		match = m != ""
+		if match && rv == "" {
 			rv = m
 		}
 	}
@@ -341,7 +623,81 @@ func matchfilterX(h *ActivityPubActivity, f *Filter) string {
 	return ""
 }
 
+// match returns a description of the cause, or empty
+func (fc *FiltCond) match(h *ActivityPubActivity) string {
+	switch fc.Op {
+	case "and":
+		rv := ""
+		for _, sub := range fc.Sub {
+			m := sub.match(h)
+			if m == "" {
+				return ""
+			}
+			if rv == "" {
+				rv = m
+			}
+		}
+		return rv
+	case "or":
+		for _, sub := range fc.Sub {
+			if m := sub.match(h); m != "" {
+				return m
+			}
+		}
+		return ""
+	case "not":
+		if len(fc.Sub) > 0 && fc.Sub[0].match(h) == "" {
+			return "not " + fc.Sub[0].String()
+		}
+		return ""
+	}
+	rv := fc.String()
+	if fc.Actor != "" && !matchactor(h, fc.Actor, false) {
+		return ""
+	}
+	if fc.Text != "" {
+		m := matchtext(h, fc.re_text)
+		if m == "" {
+			return ""
+		}
+		rv = m
+	}
+	if fc.Hashtag != "" && !matchhashtag(h, fc.Hashtag) {
+		return ""
+	}
+	if fc.Media != "" && !matchmedia(h, fc.Media) {
+		return ""
+	}
+	if fc.Lang != "" && !matchlang(h, fc.Lang) {
+		return ""
+	}
+	if fc.MinMentions > 0 && len(h.Mentions) < fc.MinMentions {
+		return ""
+	}
+	if fc.IsReply && h.InReplyToID == "" {
+		return ""
+	}
+	if fc.IsTopLevel && h.InReplyToID != "" {
+		return ""
+	}
+	if fc.IsAnnounce && h.Oonker == "" {
+		return ""
+	}
+	return rv
+}
+
 func rejectxonk(xonk *ActivityPubActivity) bool {
+	return rejectxonkX(xonk, false)
+}
+
+// fastrejectxonk checks the filters that can be decided before
+// attachments are fetched and the rest of the object is parsed.
+// The full check follows later.
+func fastrejectxonk(xonk *ActivityPubActivity) bool {
+	return rejectxonkX(xonk, true)
+}
+
+func rejectxonkX(xonk *ActivityPubActivity, fast bool) bool {
 	var m arejectmap
 	rejectcache.Get(xonk.UserID, &m)
 	filts := m[rejectAnyKey]
@@ -354,8 +710,12 @@ func rejectxonk(xonk *ActivityPubActivity) bool {
 		filts = append(filts, m[originate(a)]...)
 	}
 	for _, f := range filts {
+		if fast && f.needsParsed() {
+			continue
+		}
 		if cause := matchfilterX(xonk, f); cause != "" {
 			ilog.Printf("rejecting %s because %s", xonk.XID, cause)
+			filthit(f, xonk.XID)
 			return true
 		}
 	}
@@ -366,6 +726,7 @@ func skipMedia(xonk *ActivityPubActivity) bool {
 	filts := getfilters(xonk.UserID, filtSkipMedia)
 	for _, f := range filts {
 		if matchfilter(xonk, f) {
+			filthit(f, xonk.XID)
 			return true
 		}
 	}
@@ -439,6 +800,20 @@ func matchFilters(h *ActivityPubActivity, filts []*Filter) bool {
 	return false
 }
 
+// countseen counts the hide, collapse, and rewrite filters a honk matches,
+// once, as it's saved. They're applied again on every view, without counting.
+func countseen(h *ActivityPubActivity) {
+	counted := make(map[*Filter]bool)
+	for _, scope := range []filtType{filtHide, filtCollapse, filtRewrite} {
+		for _, f := range getfilters(h.UserID, scope) {
+			if !counted[f] && matchfilter(h, f) {
+				filthit(f, h.XID)
+				counted[f] = true
+			}
+		}
+	}
+}
+
 func osmosis(honks []*ActivityPubActivity, userid int64, withfilt bool) []*ActivityPubActivity {
 	var badparents map[string]bool
 	untagged.GetAndLock(userid, &badparents)
@@ -470,3 +845,476 @@ func osmosis(honks []*ActivityPubActivity, userid int64, withfilt bool) []*Activ
 	honks = honks[0:j]
 	return honks
 }
+
+// parseFiltCond reads a condition such as
+// #politics and not media:image or (lang:de mentions>10)
+// Adjacent terms are joined with and, which binds tighter than or.
+func parseFiltCond(s string) (*FiltCond, error) {
+	s = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s)
+	toks := strings.Fields(s)
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	fc, rest, err := parseFiltOr(toks)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("unexpected %s", rest[0])
+	}
+	return fc, fc.compile()
+}
+
+func parseFiltOr(toks []string) (*FiltCond, []string, error) {
+	fc, toks, err := parseFiltAnd(toks)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(toks) > 0 && strings.EqualFold(toks[0], "or") {
+		var next *FiltCond
+		next, toks, err = parseFiltAnd(toks[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if fc.Op != "or" {
+			fc = &FiltCond{Op: "or", Sub: []*FiltCond{fc}}
+		}
+		fc.Sub = append(fc.Sub, next)
+	}
+	return fc, toks, nil
+}
+
+func parseFiltAnd(toks []string) (*FiltCond, []string, error) {
+	fc, toks, err := parseFiltNot(toks)
+	if err != nil {
+		return nil, nil, err
+	}
+	for len(toks) > 0 && toks[0] != ")" && !strings.EqualFold(toks[0], "or") {
+		if strings.EqualFold(toks[0], "and") {
+			toks = toks[1:]
+		}
+		var next *FiltCond
+		next, toks, err = parseFiltNot(toks)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fc.Op != "and" {
+			fc = &FiltCond{Op: "and", Sub: []*FiltCond{fc}}
+		}
+		fc.Sub = append(fc.Sub, next)
+	}
+	return fc, toks, nil
+}
+
+func parseFiltNot(toks []string) (*FiltCond, []string, error) {
+	if len(toks) == 0 {
+		return nil, nil, fmt.Errorf("missing condition")
+	}
+	tok := toks[0]
+	toks = toks[1:]
+	switch {
+	case strings.EqualFold(tok, "not"):
+		sub, toks, err := parseFiltNot(toks)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &FiltCond{Op: "not", Sub: []*FiltCond{sub}}, toks, nil
+	case tok == "(":
+		fc, toks, err := parseFiltOr(toks)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(toks) == 0 || toks[0] != ")" {
+			return nil, nil, fmt.Errorf("missing )")
+		}
+		return fc, toks[1:], nil
+	}
+	fc := new(FiltCond)
+	key, val := "tag", tok
+	if tok[0] != '#' {
+		if idx := strings.IndexAny(tok, ":>"); idx != -1 {
+			key, val = strings.ToLower(tok[:idx]), tok[idx+1:]
+			if tok[idx] == '>' {
+				key += ">"
+			}
+		} else {
+			key = "text"
+		}
+	}
+	if val == "" {
+		return nil, nil, fmt.Errorf("empty condition: %s", tok)
+	}
+	switch key {
+	case "tag":
+		fc.Hashtag = val
+		if val[0] != '#' {
+			fc.Hashtag = "#" + val
+		}
+	case "media":
+		fc.Media = strings.ToLower(val)
+	case "lang":
+		fc.Lang = strings.ToLower(val)
+	case "from":
+		fc.Actor = val
+	case "text":
+		fc.Text = val
+	case "mentions>":
+		n, err := strconv.Atoi(strings.TrimPrefix(val, "="))
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad mention count: %s", tok)
+		}
+		if val[0] != '=' {
+			n++
+		}
+		fc.MinMentions = n
+	case "is":
+		switch strings.ToLower(val) {
+		case "reply":
+			fc.IsReply = true
+		case "toplevel":
+			fc.IsTopLevel = true
+		case "announce":
+			fc.IsAnnounce = true
+		default:
+			return nil, nil, fmt.Errorf("unknown condition: %s", tok)
+		}
+	default:
+		return nil, nil, fmt.Errorf("unknown condition: %s", tok)
+	}
+	return fc, toks, nil
+}
+
+func (fc *FiltCond) String() string {
+	if fc == nil {
+		return ""
+	}
+	switch fc.Op {
+	case "and", "or":
+		var parts []string
+		for _, sub := range fc.Sub {
+			s := sub.String()
+			if sub.Op == "and" || sub.Op == "or" {
+				s = "(" + s + ")"
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " "+fc.Op+" ")
+	case "not":
+		if len(fc.Sub) == 0 {
+			return "not"
+		}
+		s := fc.Sub[0].String()
+		if fc.Sub[0].Op == "and" || fc.Sub[0].Op == "or" {
+			s = "(" + s + ")"
+		}
+		return "not " + s
+	}
+	var parts []string
+	if fc.Actor != "" {
+		parts = append(parts, "from:"+fc.Actor)
+	}
+	if fc.Text != "" {
+		parts = append(parts, "text:"+fc.Text)
+	}
+	if fc.Hashtag != "" {
+		parts = append(parts, fc.Hashtag)
+	}
+	if fc.Media != "" {
+		parts = append(parts, "media:"+fc.Media)
+	}
+	if fc.Lang != "" {
+		parts = append(parts, "lang:"+fc.Lang)
+	}
+	if fc.MinMentions > 0 {
+		parts = append(parts, fmt.Sprintf("mentions>=%d", fc.MinMentions))
+	}
+	if fc.IsReply {
+		parts = append(parts, "is:reply")
+	}
+	if fc.IsTopLevel {
+		parts = append(parts, "is:toplevel")
+	}
+	if fc.IsAnnounce {
+		parts = append(parts, "is:announce")
+	}
+	return strings.Join(parts, " and ")
+}
+
+// filtkey reduces a filter to what it matches and does, for finding duplicates
+func filtkey(filt *Filter) string {
+	f := *filt
+	f.Name = ""
+	f.Notes = ""
+	f.Date = time.Time{}
+	f.Expiration = time.Time{}
+	j, _ := json.Marshal(&f)
+	return string(j)
+}
+
+// importfilters accepts either our own json export or a mastodon domain block csv
+func importfilters(userid int64, data []byte) (added int, dups int, err error) {
+	var filts []*Filter
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &filts)
+	} else {
+		filts, err = parsedomainblocks(data)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	have := make(map[string]bool)
+	for _, f := range getfilters(userid, filtAny) {
+		have[filtkey(f)] = true
+	}
+	now := time.Now()
+	for _, f := range filts {
+		if !f.Expiration.IsZero() && f.Expiration.Before(now) {
+			continue
+		}
+		if f.Actor == "" && f.Text == "" && !f.IsAnnounce && !f.hasExtras() {
+			continue
+		}
+		if err := f.compile(); err != nil {
+			ilog.Printf("skipping bad filter: %s", err)
+			continue
+		}
+		key := filtkey(f)
+		if have[key] {
+			dups++
+			continue
+		}
+		have[key] = true
+		if f.Date.IsZero() {
+			f.Date = now.UTC()
+		}
+		j, err := encodeJson(f)
+		if err == nil {
+			_, err = stmtSaveFilter.Exec(userid, j)
+		}
+		if err != nil {
+			elog.Printf("error saving filter: %s", err)
+			continue
+		}
+		added++
+	}
+	filtersChanged(userid)
+	return added, dups, nil
+}
+
+// parsedomainblocks reads the mastodon export format.
+// The header may be domain,severity,reject_media,... with or without #,
+// or there may be no header and just a list of domains.
+func parsedomainblocks(data []byte) ([]*Filter, error) {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	cols := map[string]int{"domain": 0, "severity": -1, "reject_media": -1, "public_comment": -1}
+	if len(records) > 0 && strings.Contains(strings.Join(records[0], ","), "domain") {
+		for k := range cols {
+			cols[k] = -1
+		}
+		for i, name := range records[0] {
+			name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+			if _, ok := cols[name]; ok {
+				cols[name] = i
+			}
+		}
+		records = records[1:]
+		if cols["domain"] == -1 {
+			return nil, fmt.Errorf("no domain column")
+		}
+	}
+	field := func(rec []string, name string) string {
+		i := cols[name]
+		if i < 0 || i >= len(rec) {
+			return ""
+		}
+		return strings.TrimSpace(rec[i])
+	}
+	var filts []*Filter
+	for _, rec := range records {
+		domain := strings.ToLower(field(rec, "domain"))
+		if domain == "" || domain[0] == '#' {
+			continue
+		}
+		f := new(Filter)
+		f.Name = domain
+		f.Actor = domain
+		f.Notes = field(rec, "public_comment")
+		switch strings.ToLower(field(rec, "severity")) {
+		case "", "suspend":
+			f.Reject = true
+		case "silence":
+			f.Hide = true
+		case "noop":
+		default:
+			ilog.Printf("unknown severity for %s", domain)
+			f.Reject = true
+		}
+		if rm, _ := strconv.ParseBool(field(rec, "reject_media")); rm {
+			f.SkipMedia = true
+		}
+		if !f.Reject && !f.Hide && !f.SkipMedia {
+			continue
+		}
+		filts = append(filts, f)
+	}
+	return filts, nil
+}
+
+// FilterTrial is what a proposed filter would do to one honk
+type FilterTrial struct {
+	Honk    *ActivityPubActivity
+	Cause   string
+	Actions []filtType
+	Before  string
+	After   string
+}
+
+func tryfilter(filt *Filter, honks []*ActivityPubActivity) []*FilterTrial {
+	var trials []*FilterTrial
+	for _, h := range honks {
+		cause := matchfilterX(h, filt)
+		if cause == "" {
+			continue
+		}
+		trial := &FilterTrial{Honk: h, Cause: cause, Actions: filt.Actions}
+		if filt.re_rewrite != nil {
+			trial.Before = h.Text
+			trial.After = filt.re_rewrite.ReplaceAllString(h.Text, filt.Replace)
+		}
+		trials = append(trials, trial)
+	}
+	return trials
+}
+
+// FilterStats counts how often a filter has done something
+type FilterStats struct {
+	Hits    int64
+	Last    time.Time
+	Samples []string
+}
+
+const filtSampleCount = 5
+
+var filtstats map[int64]*FilterStats
+var filtstatsdirty = make(map[int64]bool)
+var filtstatslock sync.Mutex
+
+// call with lock held
+func loadfiltstats() {
+	if filtstats != nil {
+		return
+	}
+	filtstats = make(map[int64]*FilterStats)
+	rows, err := stmtGetFilterStats.Query()
+	if err != nil {
+		elog.Printf("error querying filter stats: %s", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var dt, samples string
+		st := new(FilterStats)
+		err := rows.Scan(&id, &st.Hits, &dt, &samples)
+		if err != nil {
+			elog.Printf("error scanning filter stats: %s", err)
+			continue
+		}
+		st.Last, _ = time.Parse(dbtimeformat, dt)
+		if samples != "" {
+			st.Samples = strings.Split(samples, " ")
+		}
+		filtstats[id] = st
+	}
+}
+
+func filthit(f *Filter, xid string) {
+	if f.ID == 0 {
+		return
+	}
+	filtstatslock.Lock()
+	defer filtstatslock.Unlock()
+	loadfiltstats()
+	st := filtstats[f.ID]
+	if st == nil {
+		st = new(FilterStats)
+		filtstats[f.ID] = st
+	}
+	st.Hits++
+	st.Last = time.Now().UTC()
+	for i, s := range st.Samples {
+		if s == xid {
+			st.Samples = append(st.Samples[:i], st.Samples[i+1:]...)
+			break
+		}
+	}
+	st.Samples = append([]string{xid}, st.Samples...)
+	if len(st.Samples) > filtSampleCount {
+		st.Samples = st.Samples[:filtSampleCount]
+	}
+	filtstatsdirty[f.ID] = true
+}
+
+// Stats returns a copy of the filter's stats, or nil if it never matched
+func (filt *Filter) Stats() *FilterStats {
+	filtstatslock.Lock()
+	defer filtstatslock.Unlock()
+	loadfiltstats()
+	st := filtstats[filt.ID]
+	if st == nil {
+		return nil
+	}
+	c := *st
+	c.Samples = append([]string(nil), st.Samples...)
+	return &c
+}
+
+func forgetfiltstats(hfcsid int64) {
+	filtstatslock.Lock()
+	loadfiltstats()
+	delete(filtstats, hfcsid)
+	delete(filtstatsdirty, hfcsid)
+	filtstatslock.Unlock()
+	_, err := stmtDeleteFilterStats.Exec(hfcsid)
+	if err != nil {
+		elog.Printf("error deleting filter stats: %s", err)
+	}
+}
+
+func flushfiltstats() {
+	filtstatslock.Lock()
+	type saved struct {
+		id      int64
+		hits    int64
+		dt      string
+		samples string
+	}
+	var pending []saved
+	for id := range filtstatsdirty {
+		st := filtstats[id]
+		pending = append(pending, saved{id, st.Hits, st.Last.Format(dbtimeformat), strings.Join(st.Samples, " ")})
+	}
+	filtstatsdirty = make(map[int64]bool)
+	filtstatslock.Unlock()
+	for _, s := range pending {
+		_, err := stmtSaveFilterStats.Exec(s.id, s.hits, s.dt, s.samples)
+		if err != nil {
+			elog.Printf("error saving filter stats: %s", err)
+		}
+	}
+}
+
+// counting happens in memory, and is saved every few minutes
+func filtstatsflusher() {
+	for {
+		time.Sleep(5 * time.Minute)
+		flushfiltstats()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseFiltCond(t *testing.T) {
+	tests := []struct {
+		in, out string
+		bad     bool
+	}{
+		{in: "", out: ""},
+		{in: "#politics", out: "#politics"},
+		{in: "tag:politics", out: "#politics"},
+		{in: "media:IMAGE", out: "media:image"},
+		{in: "lang:DE", out: "lang:de"},
+		{in: "is:reply", out: "is:reply"},
+		{in: "is:toplevel", out: "is:toplevel"},
+		{in: "#a #b", out: "#a and #b"},
+		{in: "#a and #b or #c", out: "(#a and #b) or #c"},
+		{in: "#a and (#b or #c)", out: "#a and (#b or #c)"},
+		{in: "not #a", out: "not #a"},
+		{in: "not (#a or #b)", out: "not (#a or #b)"},
+		{in: "#politics and not media:image or (lang:de mentions>10)",
+			out: "(#politics and not media:image) or (lang:de and mentions>=11)"},
+		{in: "mentions>=3", out: "mentions>=3"},
+		{in: "(#a", bad: true},
+		{in: "#a )", bad: true},
+		{in: "not", bad: true},
+		{in: "is:sideways", bad: true},
+		{in: "mentions>many", bad: true},
+		{in: "lang:", bad: true},
+		{in: "bogus:thing", bad: true},
+		{in: "text:(", bad: true},
+	}
+	for _, test := range tests {
+		fc, err := parseFiltCond(test.in)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%q: expected error, got %s", test.in, fc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.in, err)
+			continue
+		}
+		if s := fc.String(); s != test.out {
+			t.Errorf("%q: got %q, expected %q", test.in, s, test.out)
+		}
+	}
+}
+
+func TestMatchfilterX(t *testing.T) {
+	toplevel := &ActivityPubActivity{
+		XID:      "https://remote.example/n/1",
+		Author:   "https://remote.example/u/alice",
+		Text:     "<p>hello world #Cats</p>",
+		Hashtags: []string{"#cats"},
+		Lang:     "en-US",
+		Attachments: []*Attachment{
+			{Media: "image/png", Desc: "a cat"},
+		},
+		Mentions: []Mention{{Who: "@a"}, {Who: "@b"}},
+	}
+	reply := &ActivityPubActivity{
+		XID:         "https://other.example/n/2",
+		Author:      "https://other.example/u/bob",
+		InReplyToID: toplevel.XID,
+		Text:        "<p>meow</p>",
+		Oonker:      "https://remote.example/u/alice",
+	}
+	tests := []struct {
+		name  string
+		filt  Filter
+		cond  string
+		h     *ActivityPubActivity
+		cause string
+	}{
+		{name: "actor", filt: Filter{Actor: "https://remote.example/u/alice"}, h: toplevel, cause: "https://remote.example/u/alice"},
+		{name: "origin", filt: Filter{Actor: "remote.example"}, h: toplevel, cause: "remote.example"},
+		{name: "actor miss", filt: Filter{Actor: "nowhere.example"}, h: toplevel},
+		{name: "text", filt: Filter{Text: "world"}, h: toplevel, cause: "world"},
+		{name: "text desc", filt: Filter{Text: "a cat"}, h: toplevel, cause: "a cat"},
+		{name: "text miss", filt: Filter{Text: "dogs"}, h: toplevel},
+		{name: "hashtag", filt: Filter{Hashtag: "#CATS"}, h: toplevel, cause: "#CATS"},
+		{name: "media class", filt: Filter{Media: "image"}, h: toplevel, cause: "image"},
+		{name: "media miss", filt: Filter{Media: "video"}, h: toplevel},
+		{name: "lang prefix", filt: Filter{Lang: "en"}, h: toplevel, cause: "en"},
+		{name: "mentions", filt: Filter{MinMentions: 2}, h: toplevel, cause: "mentions"},
+		{name: "mentions miss", filt: Filter{MinMentions: 3}, h: toplevel},
+		{name: "reply", filt: Filter{IsReply: true}, h: reply, cause: "reply"},
+		{name: "reply miss", filt: Filter{IsReply: true}, h: toplevel},
+		{name: "toplevel", filt: Filter{IsTopLevel: true}, h: toplevel, cause: "toplevel"},
+		{name: "toplevel miss", filt: Filter{IsTopLevel: true}, h: reply},
+		{name: "announce", filt: Filter{IsAnnounce: true}, h: reply, cause: " announce"},
+		{name: "announce of", filt: Filter{IsAnnounce: true, AnnounceOf: "remote.example"}, h: reply, cause: " announce"},
+		{name: "announce miss", filt: Filter{IsAnnounce: true}, h: toplevel},
+		{name: "actor and text", filt: Filter{Actor: "remote.example", Text: "hello"}, h: toplevel, cause: "hello"},
+		{name: "actor and text miss", filt: Filter{Actor: "remote.example", Text: "meow"}, h: toplevel},
+		{name: "cond", cond: "#cats and not is:reply", h: toplevel, cause: "#cats"},
+		{name: "cond not", cond: "not #cats", h: reply, cause: "not #cats"},
+		{name: "cond not miss", cond: "not #cats", h: toplevel},
+		{name: "cond or", cond: "media:video or lang:en", h: toplevel, cause: "lang:en"},
+		{name: "cond from", cond: "from:other.example is:reply", h: reply, cause: "from:other.example"},
+	}
+	for _, test := range tests {
+		f := test.filt
+		if test.cond != "" {
+			fc, err := parseFiltCond(test.cond)
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+			f.Cond = fc
+		}
+		if err := f.compile(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if cause := matchfilterX(test.h, &f); cause != test.cause {
+			t.Errorf("%s: got %q, expected %q", test.name, cause, test.cause)
+		}
+	}
+}
+
+func TestFilterNeedsParsed(t *testing.T) {
+	tests := []struct {
+		filt Filter
+		cond string
+		need bool
+	}{
+		{filt: Filter{Actor: "remote.example"}},
+		{filt: Filter{Text: "hello"}},
+		{filt: Filter{Lang: "en"}},
+		{filt: Filter{IsTopLevel: true}, need: true},
+		{filt: Filter{IsReply: true}, need: true},
+		{filt: Filter{Hashtag: "#cats"}, need: true},
+		{filt: Filter{Media: "image"}, need: true},
+		{filt: Filter{MinMentions: 3}, need: true},
+		{cond: "from:remote.example or text:hello"},
+		{cond: "is:toplevel", need: true},
+		{cond: "not #cats", need: true},
+		{cond: "lang:en and not media:image", need: true},
+	}
+	for _, test := range tests {
+		f := test.filt
+		if test.cond != "" {
+			fc, err := parseFiltCond(test.cond)
+			if err != nil {
+				t.Fatalf("%s: %s", test.cond, err)
+			}
+			f.Cond = fc
+		}
+		if need := f.needsParsed(); need != test.need {
+			t.Errorf("%+v %s: got %v", test.filt, test.cond, need)
+		}
+	}
+}
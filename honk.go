@@ -105,6 +105,8 @@ type ActivityPubActivity struct {
 	Mentions    []Mention
 	Reactions   []Reaction
 	Guesses     template.HTML
+	Lang        string
+	Revisions   []OldRevision
 }
 
 type Reaction struct {
@@ -148,6 +150,8 @@ func (mention *Mention) IsPresent(text string) bool {
 type OldRevision struct {
 	Precis string
 	Text   string
+	Format string `json:",omitempty"`
+	Date   time.Time
 }
 
 const (
@@ -166,6 +170,7 @@ func (honk *ActivityPubActivity) IsShared() bool {
 	return honk.Flags&flagIsShared != 0
 }
 
+// IsSaved is set when loaded for honks in the saved collection
 func (honk *ActivityPubActivity) IsSaved() bool {
 	return honk.Flags&flagIsSaved != 0
 }
@@ -187,6 +192,10 @@ type Attachment struct {
 	Media    string
 	Local    bool
 	External bool
+	Blurhash string
+	Width    int
+	Height   int
+	Duration Duration
 }
 
 type Place struct {
@@ -282,7 +291,7 @@ func reexecArgs(cmd string) []string {
 	return args
 }
 
-var elog, ilog, dlog *golog.Logger
+var elog, ilog, dlog *golog.Logger = log.E, log.I, log.D
 
 func main() {
 	flag.StringVar(&dataDir, "datadir", dataDir, "data directory")
@@ -329,6 +338,12 @@ func main() {
 	getConfigValue("fasttimeout", &fastTimeout)
 	getConfigValue("slowtimeout", &slowTimeout)
 	getConfigValue("signgets", &signGets)
+	getConfigValue("allowlist", &allowlistMode)
+	getConfigValue("retentionhours", &retentionHours)
+	getConfigValue("mediastore", &mediaStoreName)
+	getConfigValue("proxycachemb", &proxyCacheMB)
+	getConfigValue("gifstill", &stillGifs)
+	getConfigValue("maxattachments", &maxAttachments)
 	prepareStatements(db)
 	switch cmd {
 	case "admin":
@@ -376,6 +391,17 @@ func main() {
 			arg = args[1]
 		}
 		cleanupdb(arg)
+	case "retention":
+		retentionMain(args[1:])
+	case "migrate-media":
+		if len(args) < 2 {
+			fmt.Printf("usage: honk migrate-media blob|files\n")
+			return
+		}
+		err := migratemedia(mediaStoreName, args[1])
+		if err != nil {
+			elog.Fatalf("error migrating media: %s", err)
+		}
 	case "unplug":
 		if len(args) < 2 {
 			fmt.Printf("usage: honk unplug servername\n")
@@ -383,6 +409,8 @@ func main() {
 		}
 		name := args[1]
 		unplugserver(name)
+	case "policy":
+		policyMain(args[1:])
 	case "ping":
 		if len(args) < 3 {
 			fmt.Printf("usage: honk ping (from username) (to username or url)\n")
@@ -0,0 +1,178 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package image
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+
+	"golang.org/x/image/draw"
+)
+
+var errTooAnimated = errors.New("animation is too large")
+
+// decoding every frame of a big animation takes a lot of memory
+const maxAnimPixels = 64 * 1024 * 1024
+
+// vacuumgif scales an animation to fit, frame by frame,
+// shrinking it further until it's small enough.
+func vacuumgif(data []byte, maxw, maxh int, params Params) (*Image, error) {
+	stripped, frames, err := stripgif(data)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := gif.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	maxframes := params.MaxFrames
+	if maxframes == 0 {
+		maxframes = 400
+	}
+	maxsize := params.MaxAnimSize
+	if maxsize == 0 {
+		maxsize = 4 * 1024 * 1024
+	}
+	if frames > maxframes || conf.Width*conf.Height*frames > maxAnimPixels {
+		return nil, errTooAnimated
+	}
+	if conf.Width <= maxw && conf.Height <= maxh && len(stripped) <= maxsize {
+		return &Image{
+			Data:   stripped,
+			Format: "gif",
+			Width:  conf.Width,
+			Height: conf.Height,
+		}, nil
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(stripped))
+	if err != nil {
+		return nil, err
+	}
+	w, h := conf.Width, conf.Height
+	if w > maxw {
+		h = h * maxw / w
+		w = maxw
+	}
+	if h > maxh {
+		w = w * maxh / h
+		h = maxh
+	}
+	for tries := 0; tries < 4 && w > 0 && h > 0; tries++ {
+		anim, err := scalegif(g, w, h)
+		if err != nil {
+			return nil, err
+		}
+		if len(anim) <= maxsize {
+			return &Image{
+				Data:   anim,
+				Format: "gif",
+				Width:  w,
+				Height: h,
+			}, nil
+		}
+		w, h = w*3/4, h*3/4
+	}
+	return nil, errTooAnimated
+}
+
+// scalegif draws each frame as it would be displayed, then scales it.
+// The output frames are all full size, so disposal doesn't matter.
+func scalegif(g *gif.GIF, w, h int) ([]byte, error) {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	canvas := image.NewRGBA(screen)
+	out := &gif.GIF{
+		Delay:     g.Delay,
+		LoopCount: g.LoopCount,
+	}
+	for i, frame := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var saved *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			saved = image.NewRGBA(screen)
+			copy(saved.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.BiLinear.Scale(scaled, scaled.Bounds(), canvas, screen, draw.Src, nil)
+		// the canvas may still show colors from earlier frames,
+		// which this frame's palette needn't have
+		out.Image = append(out.Image, quantize(scaled, canvaspalette(canvas)))
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, out)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// canvaspalette is every color on the canvas, if there are few enough,
+// or else a fixed palette that does well enough with anything.
+func canvaspalette(canvas *image.RGBA) color.Palette {
+	seen := make(map[color.RGBA]bool)
+	var pal color.Palette
+	for i := 0; i < len(canvas.Pix); i += 4 {
+		c := color.RGBA{canvas.Pix[i], canvas.Pix[i+1], canvas.Pix[i+2], canvas.Pix[i+3]}
+		if seen[c] {
+			continue
+		}
+		if len(pal) == 256 {
+			pal = nil
+			break
+		}
+		seen[c] = true
+		pal = append(pal, c)
+	}
+	if len(pal) == 0 {
+		pal = append(color.Palette{color.Transparent}, palette.WebSafe...)
+	}
+	return pal
+}
+
+// quantize maps each pixel to the nearest palette color, remembering
+// answers for similar colors, which is much faster than draw.Draw.
+// No dithering, it would shimmer from frame to frame.
+func quantize(src *image.RGBA, pal color.Palette) *image.Paletted {
+	pm := image.NewPaletted(src.Bounds(), pal)
+	var cache [1 << 16]int16
+	for i := range cache {
+		cache[i] = -1
+	}
+	for i := 0; i < len(src.Pix); i += 4 {
+		r, g, b, a := src.Pix[i], src.Pix[i+1], src.Pix[i+2], src.Pix[i+3]
+		key := int(a>>7)<<15 | int(r>>3)<<10 | int(g>>3)<<5 | int(b>>3)
+		idx := cache[key]
+		if idx == -1 {
+			idx = int16(pal.Index(color.RGBA{r, g, b, a}))
+			cache[key] = idx
+		}
+		pm.Pix[i/4] = uint8(idx)
+	}
+	return pm
+}
@@ -0,0 +1,144 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+var (
+	red  = color.RGBA{255, 0, 0, 255}
+	blue = color.RGBA{0, 0, 255, 255}
+)
+
+// sampleanim is a red screen, then frames that each paint a blue
+// square in the corner with a palette that has no red in it
+func sampleanim(t *testing.T, w, h, frames int) []byte {
+	anim := &gif.GIF{Config: image.Config{Width: w, Height: h}}
+	first := image.NewPaletted(image.Rect(0, 0, w, h), color.Palette{red})
+	anim.Image = append(anim.Image, first)
+	anim.Delay = append(anim.Delay, 10)
+	anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	for i := 1; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{blue})
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10+i)
+		anim.Disposal = append(anim.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVacuumgif(t *testing.T) {
+	data := sampleanim(t, 32, 32, 3)
+	img, err := Vacuum(bytes.NewReader(data), Params{MaxWidth: 16, MaxHeight: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != "gif" || img.Width != 16 || img.Height != 16 {
+		t.Fatalf("got %s %dx%d", img.Format, img.Width, img.Height)
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(img.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("got %d frames", len(g.Image))
+	}
+	for i, d := range []int{10, 11, 12} {
+		if g.Delay[i] != d {
+			t.Errorf("frame %d: delay %d, expected %d", i, g.Delay[i], d)
+		}
+	}
+	for i, frame := range g.Image {
+		if c := color.RGBAModel.Convert(frame.At(15, 15)); c != red {
+			t.Errorf("frame %d: far corner is %v", i, c)
+		}
+		want := blue
+		if i == 0 {
+			want = red
+		}
+		if c := color.RGBAModel.Convert(frame.At(0, 0)); c != want {
+			t.Errorf("frame %d: near corner is %v", i, c)
+		}
+	}
+
+	// small enough already, passed through
+	img, err = Vacuum(bytes.NewReader(data), Params{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Format != "gif" || img.Width != 32 {
+		t.Errorf("got %s %dx%d", img.Format, img.Width, img.Height)
+	}
+}
+
+func TestVacuumgifLimits(t *testing.T) {
+	frames := sampleanim(t, 32, 32, 5)
+	// a huge screen with tiny frames is still huge to decode
+	anim := &gif.GIF{Config: image.Config{Width: 6000, Height: 6000}}
+	for i := 0; i < 2; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), color.Palette{red}))
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	huge := buf.Bytes()
+	tests := []struct {
+		name   string
+		data   []byte
+		params Params
+		format string
+		bad    bool
+	}{
+		{name: "frames ok", data: frames, params: Params{MaxFrames: 5}, format: "gif"},
+		{name: "too many frames", data: frames, params: Params{MaxFrames: 4}, bad: true},
+		{name: "too many frames still", data: frames, params: Params{MaxFrames: 4, StillAnims: true}, format: "png"},
+		{name: "too many pixels", data: huge, bad: true},
+		{name: "too many pixels still", data: huge, params: Params{StillAnims: true}, format: "png"},
+	}
+	for _, test := range tests {
+		img, err := Vacuum(bytes.NewReader(test.data), test.params)
+		if test.bad {
+			if err != errTooAnimated {
+				t.Errorf("%s: got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if img.Format != test.format {
+			t.Errorf("%s: got %s", test.name, img.Format)
+		}
+		if img.Format == "png" {
+			if _, err := png.Decode(bytes.NewReader(img.Data)); err != nil {
+				t.Errorf("%s: %s", test.name, err)
+			}
+		}
+	}
+}
+
+func TestCanvaspalette(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	canvas.Set(0, 0, red)
+	if pal := canvaspalette(canvas); len(pal) != 2 {
+		t.Errorf("two colors: got %d", len(pal))
+	}
+	for i := 0; i < 400; i++ {
+		canvas.Set(i%20, i/20, color.RGBA{uint8(i), uint8(i / 2), 0, 255})
+	}
+	pal := canvaspalette(canvas)
+	if len(pal) > 256 || pal[0] != color.Transparent {
+		t.Errorf("many colors: got %d", len(pal))
+	}
+}
@@ -0,0 +1,213 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package image
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// blurhash, as described at https://blurha.sh and used by mastodon
+
+const digits83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encode83(b *strings.Builder, v int, length int) {
+	for i := 1; i <= length; i++ {
+		d := v / int(math.Pow(83, float64(length-i))) % 83
+		b.WriteByte(digits83[d])
+	}
+}
+
+func decode83(s string) (int, error) {
+	v := 0
+	for i := 0; i < len(s); i++ {
+		d := strings.IndexByte(digits83, s[i])
+		if d == -1 {
+			return 0, fmt.Errorf("bad blurhash character: %c", s[i])
+		}
+		v = v*83 + d
+	}
+	return v, nil
+}
+
+func signpow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+// rounded, unlike delineate, as the reference encoder does
+func tosrgb(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+// blurhash computes the hash of an image, which should already be small
+func blurhash(img image.Image) string {
+	// nobody needs more detail than this for a placeholder
+	bounds := img.Bounds()
+	if bounds.Dx() > 64 || bounds.Dy() > 64 {
+		w, h := 64, 64
+		if bounds.Dx() > bounds.Dy() {
+			h = bounds.Dy()*64/bounds.Dx() + 1
+		} else {
+			w = bounds.Dx()*64/bounds.Dy() + 1
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		draw.BiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+		img = dst
+		bounds = dst.Bounds()
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	if w == 0 || h == 0 {
+		return ""
+	}
+	xcomp, ycomp := 4, 3
+	if h > w {
+		xcomp, ycomp = 3, 4
+	}
+
+	// linear pixel values, to avoid doing it once per component
+	pix := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+			pix[y*w+x] = [3]float64{float64(lineate(c.R)), float64(lineate(c.G)), float64(lineate(c.B))}
+		}
+	}
+	factors := make([][3]float64, 0, xcomp*ycomp)
+	for j := 0; j < ycomp; j++ {
+		for i := 0; i < xcomp; i++ {
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				cy := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * cy
+					p := pix[y*w+x]
+					f[0] += basis * p[0]
+					f[1] += basis * p[1]
+					f[2] += basis * p[2]
+				}
+			}
+			scale := 1.0
+			if i != 0 || j != 0 {
+				scale = 2.0
+			}
+			scale /= float64(w * h)
+			f[0] *= scale
+			f[1] *= scale
+			f[2] *= scale
+			factors = append(factors, f)
+		}
+	}
+
+	var b strings.Builder
+	encode83(&b, (xcomp-1)+(ycomp-1)*9, 1)
+	maxac := 0.0
+	for _, f := range factors[1:] {
+		for _, v := range f {
+			maxac = math.Max(maxac, math.Abs(v))
+		}
+	}
+	quantmax := int(math.Max(0, math.Min(82, math.Floor(maxac*166-0.5))))
+	maxvalue := float64(quantmax+1) / 166
+	encode83(&b, quantmax, 1)
+	dc := factors[0]
+	encode83(&b, tosrgb(dc[0])<<16|tosrgb(dc[1])<<8|tosrgb(dc[2]), 4)
+	for _, f := range factors[1:] {
+		var q [3]int
+		for k, v := range f {
+			q[k] = int(math.Max(0, math.Min(18, math.Floor(signpow(v/maxvalue, 0.5)*9+9.5))))
+		}
+		encode83(&b, q[0]*19*19+q[1]*19+q[2], 2)
+	}
+	return b.String()
+}
+
+// BlurhashImage renders a blurhash as a small image
+func BlurhashImage(hash string, width, height int) (image.Image, error) {
+	if len(hash) < 6 {
+		return nil, fmt.Errorf("blurhash too short")
+	}
+	size, err := decode83(hash[0:1])
+	if err != nil {
+		return nil, err
+	}
+	xcomp, ycomp := size%9+1, size/9+1
+	if len(hash) != 4+2*xcomp*ycomp {
+		return nil, fmt.Errorf("blurhash length mismatch")
+	}
+	quantmax, err := decode83(hash[1:2])
+	if err != nil {
+		return nil, err
+	}
+	maxvalue := float64(quantmax+1) / 166
+
+	colors := make([][3]float64, xcomp*ycomp)
+	for i := range colors {
+		if i == 0 {
+			v, err := decode83(hash[2:6])
+			if err != nil {
+				return nil, err
+			}
+			colors[0] = [3]float64{
+				float64(lineate(uint8(v >> 16))),
+				float64(lineate(uint8(v >> 8))),
+				float64(lineate(uint8(v))),
+			}
+			continue
+		}
+		v, err := decode83(hash[4+i*2 : 6+i*2])
+		if err != nil {
+			return nil, err
+		}
+		colors[i] = [3]float64{
+			signpow(float64(v/(19*19)-9)/9, 2) * maxvalue,
+			signpow(float64(v/19%19-9)/9, 2) * maxvalue,
+			signpow(float64(v%19-9)/9, 2) * maxvalue,
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var c [3]float64
+			for j := 0; j < ycomp; j++ {
+				cy := math.Cos(math.Pi * float64(y) * float64(j) / float64(height))
+				for i := 0; i < xcomp; i++ {
+					basis := math.Cos(math.Pi*float64(x)*float64(i)/float64(width)) * cy
+					f := colors[j*xcomp+i]
+					c[0] += f[0] * basis
+					c[1] += f[1] * basis
+					c[2] += f[2] * basis
+				}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{
+				R: uint8(tosrgb(c[0])),
+				G: uint8(tosrgb(c[1])),
+				B: uint8(tosrgb(c[2])),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
@@ -0,0 +1,87 @@
+package image
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// gradient images, with hashes from the reference encoder
+func gradient(w, h int, f func(x, y int) color.NRGBA) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, f(x, y))
+		}
+	}
+	return img
+}
+
+func TestBlurhash(t *testing.T) {
+	tests := []struct {
+		name string
+		img  image.Image
+		hash string
+	}{
+		{name: "wide", img: gradient(8, 6, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 32), uint8(y * 40), 128, 255}
+		}), hash: "LjF=ad3Ba|xuzONLfQnTeqf7fQf7"},
+		{name: "tall", img: gradient(6, 8, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 40), uint8(y * 32), uint8(200 - x*y*3), 255}
+		}), hash: "TjEM%|7%SQu#RUa_fBfOfOxwS$a}"},
+		{name: "one pixel", img: gradient(1, 1, func(x, y int) color.NRGBA {
+			return color.NRGBA{255, 0, 0, 255}
+		}), hash: "L~TI:j|c|c|c|c|c|c|c|c|c|c|c"},
+		{name: "empty", img: image.NewNRGBA(image.Rect(0, 0, 0, 0)), hash: ""},
+	}
+	for _, test := range tests {
+		if hash := blurhash(test.img); hash != test.hash {
+			t.Errorf("%s: got %s, expected %s", test.name, hash, test.hash)
+		}
+	}
+}
+
+func TestBlurhashImage(t *testing.T) {
+	tests := []struct {
+		hash   string
+		w, h   int
+		pixels map[image.Point]color.NRGBA
+		bad    bool
+	}{
+		{hash: "LjF=ad3Ba|xuzONLfQnTeqf7fQf7", w: 8, h: 6, pixels: map[image.Point]color.NRGBA{
+			{0, 0}: {76, 0, 177, 255},
+			{3, 2}: {99, 82, 131, 255},
+			{7, 5}: {164, 142, 83, 255},
+		}},
+		{hash: "L~TI:j|c|c|c|c|c|c|c|c|c|c|c", w: 1, h: 1, pixels: map[image.Point]color.NRGBA{
+			{0, 0}: {255, 0, 0, 255},
+		}},
+		{hash: "L~TI:j|c|c|c|c|c|c|c|c|c|c|c", w: 4, h: 4, pixels: map[image.Point]color.NRGBA{
+			{3, 3}: {210, 0, 0, 255},
+		}},
+		{hash: "LjF=a", bad: true},
+		{hash: "LjF=ad3Ba|xuzONLfQnTeqf7fQ", bad: true},
+		{hash: "LjF=ad3Ba|xuzONLfQnTeqf7fQf\\", bad: true},
+	}
+	for _, test := range tests {
+		img, err := BlurhashImage(test.hash, test.w, test.h)
+		if test.bad {
+			if err == nil {
+				t.Errorf("%s: expected error", test.hash)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.hash, err)
+			continue
+		}
+		if b := img.Bounds(); b.Dx() != test.w || b.Dy() != test.h {
+			t.Errorf("%s: got %dx%d", test.hash, b.Dx(), b.Dy())
+		}
+		for pt, want := range test.pixels {
+			if c := color.NRGBAModel.Convert(img.At(pt.X, pt.Y)); c != want {
+				t.Errorf("%s: %v is %v, expected %v", test.hash, pt, c, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,274 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+)
+
+const tagOrientation = 0x0112
+
+// findexif returns the raw TIFF structure holding the EXIF data, if any
+func findexif(data []byte, format string) []byte {
+	switch format {
+	case "jpeg":
+		return jpegexif(data)
+	case "png":
+		return pngexif(data)
+	case "webp":
+		return webpexif(data)
+	}
+	return nil
+}
+
+var exifHeader = []byte("Exif\x00\x00")
+
+func jpegexif(data []byte) []byte {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil
+	}
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil
+		}
+		marker := data[i+1]
+		// fill bytes
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// start of scan, no more metadata
+		if marker == 0xda || marker == 0xd9 {
+			return nil
+		}
+		seglen := int(binary.BigEndian.Uint16(data[i+2:]))
+		if seglen < 2 || i+2+seglen > len(data) {
+			return nil
+		}
+		seg := data[i+4 : i+2+seglen]
+		if marker == 0xe1 && bytes.HasPrefix(seg, exifHeader) {
+			return seg[len(exifHeader):]
+		}
+		i += 2 + seglen
+	}
+	return nil
+}
+
+func pngexif(data []byte) []byte {
+	i := 8
+	for i+12 <= len(data) {
+		chunklen := int(binary.BigEndian.Uint32(data[i:]))
+		if chunklen < 0 || i+12+chunklen > len(data) {
+			return nil
+		}
+		kind := string(data[i+4 : i+8])
+		if kind == "eXIf" {
+			return data[i+8 : i+8+chunklen]
+		}
+		if kind == "IDAT" || kind == "IEND" {
+			return nil
+		}
+		i += 12 + chunklen
+	}
+	return nil
+}
+
+func webpexif(data []byte) []byte {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil
+	}
+	i := 12
+	for i+8 <= len(data) {
+		chunklen := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if chunklen < 0 || i+8+chunklen > len(data) {
+			return nil
+		}
+		if string(data[i:i+4]) == "EXIF" {
+			exif := data[i+8 : i+8+chunklen]
+			return bytes.TrimPrefix(exif, exifHeader)
+		}
+		// chunks are padded to even sizes
+		i += 8 + chunklen + chunklen&1
+	}
+	return nil
+}
+
+// exiforientation reads the orientation tag from IFD0, 1 if missing
+func exiforientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) != tagOrientation {
+			continue
+		}
+		// type 3 is SHORT, stored in the first half of the value
+		if order.Uint16(tiff[entry+2:]) != 3 {
+			return 1
+		}
+		o := int(order.Uint16(tiff[entry+8:]))
+		if o < 1 || o > 8 {
+			return 1
+		}
+		return o
+	}
+	return 1
+}
+
+// orient applies one of the eight EXIF orientations
+func orient(img image.Image, o int) image.Image {
+	if o <= 1 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if o >= 5 {
+		dw, dh = h, w
+	}
+	newimg := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // upside down and mirrored
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // rotate right
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate left
+				dx, dy = y, w-1-x
+			}
+			newimg.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return newimg
+}
+
+// stripgif removes comments and metadata extensions from a gif,
+// keeping image data, frame timing, and the loop count.
+// The number of frames is returned too.
+func stripgif(data []byte) ([]byte, int, error) {
+	short := fmt.Errorf("gif truncated")
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return nil, 0, fmt.Errorf("not a gif")
+	}
+	var out bytes.Buffer
+	frames := 0
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&7 + 1)
+	}
+	if i > len(data) {
+		return nil, 0, short
+	}
+	out.Write(data[:i])
+	// skipblocks returns the offset past a run of data sub-blocks
+	skipblocks := func(i int) (int, error) {
+		for {
+			if i >= len(data) {
+				return 0, short
+			}
+			n := int(data[i])
+			i++
+			if n == 0 {
+				return i, nil
+			}
+			i += n
+		}
+	}
+	for {
+		if i >= len(data) {
+			return nil, 0, short
+		}
+		switch data[i] {
+		case 0x21:
+			if i+2 > len(data) {
+				return nil, 0, short
+			}
+			label := data[i+1]
+			end, err := skipblocks(i + 2)
+			if err != nil {
+				return nil, 0, err
+			}
+			keep := label == 0xf9 || label == 0x01
+			if label == 0xff && i+3+11 <= len(data) {
+				app := string(data[i+3 : i+3+11])
+				keep = app == "NETSCAPE2.0" || app == "ANIMEXTS1.0"
+			}
+			if keep {
+				out.Write(data[i:end])
+			}
+			i = end
+		case 0x2c:
+			start := i
+			if i+10 > len(data) {
+				return nil, 0, short
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&7 + 1)
+			}
+			// lzw code size
+			i++
+			end, err := skipblocks(i)
+			if err != nil {
+				return nil, 0, err
+			}
+			out.Write(data[start:end])
+			frames++
+			i = end
+		case 0x3b:
+			out.WriteByte(0x3b)
+			return out.Bytes(), frames, nil
+		default:
+			return nil, 0, fmt.Errorf("unknown gif block: %x", data[i])
+		}
+	}
+}
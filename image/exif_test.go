@@ -0,0 +1,250 @@
+package image
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+type byteorder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+// exiftiff makes a TIFF header and IFD0 with just an orientation
+func exiftiff(order byteorder, o int) []byte {
+	tiff := []byte("II")
+	if order == binary.BigEndian {
+		tiff = []byte("MM")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8)
+	tiff = order.AppendUint16(tiff, 1)
+	tiff = order.AppendUint16(tiff, tagOrientation)
+	tiff = order.AppendUint16(tiff, 3)
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(o))
+	tiff = order.AppendUint16(tiff, 0)
+	return order.AppendUint32(tiff, 0)
+}
+
+func pngchunk(kind string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, body...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// cornerpng is 3x2, blue but for a red top left corner
+func cornerpng(exif []byte) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	data := buf.Bytes()
+	if exif == nil {
+		return data
+	}
+	// right after the signature and IHDR
+	var out []byte
+	out = append(out, data[:33]...)
+	out = append(out, pngchunk("eXIf", exif)...)
+	return append(out, data[33:]...)
+}
+
+func TestOrientation(t *testing.T) {
+	tests := []struct {
+		o      int
+		w, h   int
+		cx, cy int
+	}{
+		{o: 1, w: 3, h: 2, cx: 0, cy: 0},
+		{o: 2, w: 3, h: 2, cx: 2, cy: 0},
+		{o: 3, w: 3, h: 2, cx: 2, cy: 1},
+		{o: 4, w: 3, h: 2, cx: 0, cy: 1},
+		{o: 5, w: 2, h: 3, cx: 0, cy: 0},
+		{o: 6, w: 2, h: 3, cx: 1, cy: 0},
+		{o: 7, w: 2, h: 3, cx: 1, cy: 2},
+		{o: 8, w: 2, h: 3, cx: 0, cy: 2},
+	}
+	for _, order := range []byteorder{binary.LittleEndian, binary.BigEndian} {
+		for _, test := range tests {
+			tiff := exiftiff(order, test.o)
+			if o := exiforientation(tiff); o != test.o {
+				t.Errorf("%s %d: read orientation %d", order, test.o, o)
+			}
+			img, err := Vacuum(bytes.NewReader(cornerpng(tiff)), Params{})
+			if err != nil {
+				t.Errorf("%s %d: %s", order, test.o, err)
+				continue
+			}
+			if img.Width != test.w || img.Height != test.h {
+				t.Errorf("%s %d: got %dx%d", order, test.o, img.Width, img.Height)
+			}
+			out, err := png.Decode(bytes.NewReader(img.Data))
+			if err != nil {
+				t.Errorf("%s %d: %s", order, test.o, err)
+				continue
+			}
+			if r, _, _, _ := out.At(test.cx, test.cy).RGBA(); r != 0xffff {
+				t.Errorf("%s %d: corner not at %d,%d", order, test.o, test.cx, test.cy)
+			}
+		}
+	}
+}
+
+func TestExiforientationGarbage(t *testing.T) {
+	good := exiftiff(binary.LittleEndian, 6)
+	patch := func(off int, b ...byte) []byte {
+		tiff := append([]byte(nil), good...)
+		copy(tiff[off:], b)
+		return tiff
+	}
+	tests := []struct {
+		name string
+		tiff []byte
+	}{
+		{name: "empty"},
+		{name: "short", tiff: good[:7]},
+		{name: "bad order", tiff: patch(0, 'X', 'X')},
+		{name: "bad magic", tiff: patch(2, 43)},
+		{name: "ifd too small", tiff: patch(4, 6)},
+		{name: "ifd past end", tiff: patch(4, 0xff, 0xff, 0xff, 0xff)},
+		{name: "ifd at end", tiff: patch(4, byte(len(good)-1))},
+		{name: "count too big", tiff: patch(8, 0xff, 0xff, 0x13)},
+		{name: "truncated entry", tiff: good[:15]},
+		{name: "wrong type", tiff: patch(12, 4)},
+		{name: "orientation 0", tiff: patch(18, 0)},
+		{name: "orientation 9", tiff: patch(18, 9)},
+	}
+	for _, test := range tests {
+		if o := exiforientation(test.tiff); o != 1 {
+			t.Errorf("%s: got %d", test.name, o)
+		}
+	}
+	// every prefix of a good one
+	for i := range good {
+		exiforientation(good[:i])
+	}
+}
+
+func TestFindexif(t *testing.T) {
+	tiff := exiftiff(binary.BigEndian, 3)
+
+	var jbuf bytes.Buffer
+	jpeg.Encode(&jbuf, image.NewGray(image.Rect(0, 0, 8, 8)), nil)
+	app1 := append([]byte(exifHeader), tiff...)
+	seg := []byte{0xff, 0xe1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(2+len(app1)))
+	seg = append(seg, app1...)
+	jpg := append(append(append([]byte(nil), jbuf.Bytes()[:2]...), seg...), jbuf.Bytes()[2:]...)
+
+	plain := cornerpng(nil)
+	late := append(append(append([]byte(nil), plain[:len(plain)-12]...), pngchunk("eXIf", tiff)...), plain[len(plain)-12:]...)
+
+	webp := func(chunks ...[]byte) []byte {
+		body := []byte("WEBP")
+		for _, c := range chunks {
+			body = append(body, c...)
+		}
+		data := []byte("RIFF")
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(body)))
+		return append(data, body...)
+	}
+	riffchunk := func(kind string, body []byte) []byte {
+		chunk := append([]byte(kind), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+		chunk = append(chunk, body...)
+		if len(body)%2 == 1 {
+			chunk = append(chunk, 0)
+		}
+		return chunk
+	}
+
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		exif   bool
+	}{
+		{name: "jpeg", format: "jpeg", data: jpg, exif: true},
+		{name: "jpeg none", format: "jpeg", data: jbuf.Bytes()},
+		{name: "jpeg truncated", format: "jpeg", data: jpg[:20]},
+		{name: "png eXIf", format: "png", data: cornerpng(tiff), exif: true},
+		{name: "png none", format: "png", data: plain},
+		{name: "png eXIf after IDAT", format: "png", data: late},
+		{name: "png truncated", format: "png", data: cornerpng(tiff)[:40]},
+		{name: "webp EXIF", format: "webp", data: webp(riffchunk("VP8X", make([]byte, 10)), riffchunk("EXIF", tiff)), exif: true},
+		{name: "webp EXIF with header", format: "webp", data: webp(riffchunk("EXIF", append([]byte(exifHeader), tiff...))), exif: true},
+		{name: "webp odd chunk", format: "webp", data: webp(riffchunk("ICCP", []byte("odd")), riffchunk("EXIF", tiff)), exif: true},
+		{name: "webp none", format: "webp", data: webp(riffchunk("VP8X", make([]byte, 10)))},
+		{name: "webp truncated", format: "webp", data: webp(riffchunk("EXIF", tiff))[:24]},
+		{name: "gif", format: "gif", data: []byte("GIF89a")},
+	}
+	for _, test := range tests {
+		exif := findexif(test.data, test.format)
+		if test.exif && !bytes.Equal(exif, tiff) {
+			t.Errorf("%s: got %x", test.name, exif)
+		}
+		if !test.exif && exif != nil {
+			t.Errorf("%s: unexpected %x", test.name, exif)
+		}
+		for i := range test.data {
+			findexif(test.data[:i], test.format)
+		}
+	}
+}
+
+func TestStripgif(t *testing.T) {
+	pal := color.Palette{color.Black, color.White}
+	anim := &gif.GIF{LoopCount: 0}
+	for i := 0; i < 2; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 4, 4), pal)
+		frame.SetColorIndex(i, i, 1)
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	clean := buf.Bytes()
+	if !bytes.Contains(clean, []byte("NETSCAPE2.0")) {
+		t.Fatal("no loop extension to keep")
+	}
+	comment := []byte{0x21, 0xfe, 5, 'h', 'e', 'l', 'l', 'o', 0}
+	xmp := append([]byte{0x21, 0xff, 11}, "XMP DataXMP"...)
+	xmp = append(xmp, 3, 'x', 'm', 'p', 0)
+	idx := bytes.Index(clean, []byte{0x21, 0xf9})
+	var dirty []byte
+	dirty = append(dirty, clean[:idx]...)
+	dirty = append(dirty, comment...)
+	dirty = append(dirty, xmp...)
+	dirty = append(dirty, clean[idx:]...)
+
+	out, frames, err := stripgif(dirty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frames != 2 {
+		t.Errorf("got %d frames", frames)
+	}
+	if !bytes.Equal(out, clean) {
+		t.Errorf("stripped gif differs from the original")
+	}
+	for i := range dirty {
+		if _, _, err := stripgif(dirty[:i]); err == nil {
+			t.Errorf("no error for %d bytes", i)
+		}
+	}
+}
@@ -37,10 +37,11 @@ func init() {
 
 // A returned image in compressed format
 type Image struct {
-	Data   []byte
-	Format string
-	Width  int
-	Height int
+	Data     []byte
+	Format   string
+	Width    int
+	Height   int
+	Blurhash string
 }
 
 // Argument for the Vacuum function
@@ -50,34 +51,10 @@ type Params struct {
 	MaxHeight int
 	MaxSize   int // max output file size in bytes
 	Quality   int // for jpeg output
-}
-
-const dirLeft = 1
-const dirRight = 2
 
-func fixrotation(img image.Image, dir int) image.Image {
-	w, h := img.Bounds().Max.X, img.Bounds().Max.Y
-	newimg := image.NewRGBA(image.Rectangle{Max: image.Point{X: h, Y: w}})
-	for j := 0; j < h; j++ {
-		for i := 0; i < w; i++ {
-			c := img.At(i, j)
-			if dir == dirLeft {
-				newimg.Set(j, w-i-1, c)
-			} else {
-				newimg.Set(h-j-1, i, c)
-			}
-		}
-	}
-	return newimg
-}
-
-var rotateLeftSigs = [][]byte{
-	{0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x08},
-	{0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x08, 0x00},
-}
-var rotateRightSigs = [][]byte{
-	{0x12, 0x01, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x06, 0x00},
-	{0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x06},
+	MaxFrames   int  // for animations
+	MaxAnimSize int  // max animation output in bytes
+	StillAnims  bool // animations over the limits become still images
 }
 
 // Read an image and shrink it down to web scale
@@ -102,6 +79,8 @@ func Vacuum(reader io.Reader, params Params) (*Image, error) {
 	if err != nil {
 		return nil, err
 	}
+	// gif only decodes the first frame, but we want all of it
+	io.Copy(io.Discard, reader)
 
 	maxh := params.MaxHeight
 	maxw := params.MaxWidth
@@ -115,20 +94,7 @@ func Vacuum(reader io.Reader, params Params) (*Image, error) {
 		params.MaxSize = 512 * 1024
 	}
 
-	if format == "jpeg" {
-		for _, sig := range rotateLeftSigs {
-			if bytes.Contains(peek, sig) {
-				img = fixrotation(img, dirLeft)
-				break
-			}
-		}
-		for _, sig := range rotateRightSigs {
-			if bytes.Contains(peek, sig) {
-				img = fixrotation(img, dirRight)
-				break
-			}
-		}
-	}
+	img = orient(img, exiforientation(findexif(totalBuf.Bytes(), format)))
 
 	bounds := img.Bounds()
 	for bounds.Max.X > maxw || bounds.Max.Y > maxh {
@@ -161,12 +127,19 @@ func Vacuum(reader io.Reader, params Params) (*Image, error) {
 	for {
 		switch format {
 		case "gif":
-			// format = "png"
-			// io.Copy(buf, io.MultiReader(bytes.NewReader(peek), bytes.NewReader(tmpFullbuf.Bytes())))
-			buf.Write(totalBuf.Bytes())
-			// png.Encode(&buf, img)
-			goto zoop
+			anim, err := vacuumgif(totalBuf.Bytes(), maxw, maxh, params)
+			if err == errTooAnimated && !params.StillAnims {
+				return nil, err
+			}
+			if err != nil {
+				// the first frame will have to do
+				format = "png"
+				continue
+			}
+			anim.Blurhash = blurhash(img)
+			return anim, nil
 		case "png":
+			// encoding anew drops any metadata chunks
 			png.Encode(&buf, img)
 		case "webp", "jpeg":
 			format = "jpeg"
@@ -186,13 +159,13 @@ func Vacuum(reader io.Reader, params Params) (*Image, error) {
 		}
 		break
 	}
-zoop:
 	rv := &Image{
 		Data:   buf.Bytes(),
 		Format: format,
 		Width:  img.Bounds().Max.X,
 		Height: img.Bounds().Max.Y,
 	}
+	rv.Blurhash = blurhash(img)
 	return rv, nil
 }
 
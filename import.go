@@ -170,7 +170,7 @@ func importMastotoots(user *UserProfile, source string) {
 					elog.Printf("error saving media: %s", fname)
 					continue
 				}
-				fileID, err := saveFileMetadata(xid, name, desc, newurl, att.MediaType)
+				fileID, err := saveFileMetadata(xid, name, desc, newurl, att.MediaType, nil)
 				if err != nil {
 					elog.Printf("error saving media: %s", fname)
 					continue
@@ -454,7 +454,7 @@ func importTwitter(username, source string) {
 				elog.Printf("error saving media: %s", fname)
 				continue
 			}
-			fileID, err := saveFileMetadata(xid, u, u, newurl, "image/jpg")
+			fileID, err := saveFileMetadata(xid, u, u, newurl, "image/jpg", nil)
 			if err != nil {
 				elog.Printf("error saving media: %s", fname)
 				continue
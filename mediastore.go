@@ -0,0 +1,351 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/benjojo/honk-benjojo/image"
+)
+
+// MediaStore holds the bytes of local attachments, keyed by xid.
+type MediaStore interface {
+	// Lookup finds a file with the same content
+	Lookup(hash string) (string, bool, error)
+	Save(xid, media, hash string, data []byte) error
+	Open(xid string) (string, io.ReadSeekCloser, error)
+	Delete(xid string) error
+	// List returns every stored xid
+	List() ([]string, error)
+}
+
+// ++ where attachments are kept, "blob" or "files"
+var mediaStoreName = "blob"
+
+var mediaStore MediaStore
+
+func openmediastore(name string, blobdb *sql.DB) (MediaStore, error) {
+	switch name {
+	case "blob":
+		return newBlobStore(blobdb), nil
+	case "files":
+		return newFileStore(blobdb, dataDir+"/media"), nil
+	}
+	return nil, fmt.Errorf("unknown media store: %s", name)
+}
+
+// renditions are stored next to the original, under a name the
+// /d/ route won't match directly
+func sizedxid(xid, size string) string {
+	return xid + "@" + size
+}
+
+func basexid(xid string) string {
+	base, _, _ := strings.Cut(xid, "@")
+	return base
+}
+
+func saveRenditions(xid string, sized map[string]*image.Image) {
+	for size, img := range sized {
+		sxid := sizedxid(xid, size)
+		if _, rd, err := mediaStore.Open(sxid); err == nil {
+			rd.Close()
+			continue
+		}
+		err := mediaStore.Save(sxid, "image/"+img.Format, hashfiledata(img.Data), img.Data)
+		if err != nil {
+			elog.Printf("error saving %s rendition of %s: %s", size, xid, err)
+		}
+	}
+}
+
+func loadmedia(store MediaStore, xid string) (string, []byte, error) {
+	media, rd, err := store.Open(xid)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rd.Close()
+	data, err := io.ReadAll(rd)
+	return media, data, err
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error { return nil }
+
+// blobStore keeps everything in the filedata table of blob.db
+type blobStore struct {
+	db                           *sql.DB
+	stmtSave, stmtCheck, stmtGet *sql.Stmt
+	stmtDelete                   *sql.Stmt
+}
+
+func newBlobStore(db *sql.DB) *blobStore {
+	bs := &blobStore{db: db}
+	bs.stmtSave = sqlMustPrepare(db, "insert into filedata (xid, media, hash, content) values (?, ?, ?, ?)")
+	// renditions have their own xids, not to be handed out again
+	bs.stmtCheck = sqlMustPrepare(db, "select xid from filedata where hash = ? and xid not like '%@%'")
+	bs.stmtGet = sqlMustPrepare(db, "select media, content from filedata where xid = ?")
+	bs.stmtDelete = sqlMustPrepare(db, "delete from filedata where xid = ?")
+	return bs
+}
+
+func (bs *blobStore) Lookup(hash string) (string, bool, error) {
+	var xid string
+	row := bs.stmtCheck.QueryRow(hash)
+	err := row.Scan(&xid)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return xid, true, nil
+}
+
+func (bs *blobStore) Save(xid, media, hash string, data []byte) error {
+	_, err := bs.stmtSave.Exec(xid, media, hash, data)
+	return err
+}
+
+func (bs *blobStore) Open(xid string) (string, io.ReadSeekCloser, error) {
+	var media string
+	var data []byte
+	row := bs.stmtGet.QueryRow(xid)
+	err := row.Scan(&media, &data)
+	if err != nil {
+		return "", nil, err
+	}
+	return media, nopCloser{bytes.NewReader(data)}, nil
+}
+
+func (bs *blobStore) Delete(xid string) error {
+	_, err := bs.stmtDelete.Exec(xid)
+	return err
+}
+
+func (bs *blobStore) List() ([]string, error) {
+	return listxids(bs.db, "select xid from filedata")
+}
+
+func listxids(db *sql.DB, q string) ([]string, error) {
+	rows, err := db.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var xids []string
+	for rows.Next() {
+		var xid string
+		err = rows.Scan(&xid)
+		if err != nil {
+			return nil, err
+		}
+		xids = append(xids, xid)
+	}
+	return xids, rows.Err()
+}
+
+// fileStore keeps content addressed files on disk.
+// The xid to hash index stays in blob.db, which is small without the content.
+type fileStore struct {
+	dir                          string
+	db                           *sql.DB
+	stmtSave, stmtCheck, stmtGet *sql.Stmt
+	stmtDelete, stmtHashUsers    *sql.Stmt
+}
+
+func newFileStore(db *sql.DB, dir string) *fileStore {
+	fs := &fileStore{db: db, dir: dir}
+	fs.stmtSave = sqlMustPrepare(db, "insert into filehashes (xid, media, hash) values (?, ?, ?)")
+	fs.stmtCheck = sqlMustPrepare(db, "select xid from filehashes where hash = ? and xid not like '%@%'")
+	fs.stmtGet = sqlMustPrepare(db, "select media, hash from filehashes where xid = ?")
+	fs.stmtDelete = sqlMustPrepare(db, "delete from filehashes where xid = ?")
+	fs.stmtHashUsers = sqlMustPrepare(db, "select count(*) from filehashes where hash = ?")
+	return fs
+}
+
+func (fs *fileStore) path(hash string) string {
+	return filepath.Join(fs.dir, hash[0:2], hash[2:4], hash)
+}
+
+func (fs *fileStore) Lookup(hash string) (string, bool, error) {
+	var xid string
+	row := fs.stmtCheck.QueryRow(hash)
+	err := row.Scan(&xid)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return xid, true, nil
+}
+
+func (fs *fileStore) Save(xid, media, hash string, data []byte) error {
+	if len(hash) < 4 {
+		return fmt.Errorf("bad hash for %s", xid)
+	}
+	p := fs.path(hash)
+	if _, err := os.Stat(p); err != nil {
+		err = os.MkdirAll(filepath.Dir(p), 0700)
+		if err != nil {
+			return err
+		}
+		// write and rename, so a partial file never has the final name
+		tmp, err := os.CreateTemp(filepath.Dir(p), "tmp-")
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(data)
+		if err == nil {
+			err = tmp.Sync()
+		}
+		if err2 := tmp.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), p)
+		}
+		if err != nil {
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	_, err := fs.stmtSave.Exec(xid, media, hash)
+	return err
+}
+
+func (fs *fileStore) Open(xid string) (string, io.ReadSeekCloser, error) {
+	var media, hash string
+	row := fs.stmtGet.QueryRow(xid)
+	err := row.Scan(&media, &hash)
+	if err != nil {
+		return "", nil, err
+	}
+	fd, err := os.Open(fs.path(hash))
+	if err != nil {
+		return "", nil, err
+	}
+	return media, fd, nil
+}
+
+func (fs *fileStore) Delete(xid string) error {
+	var media, hash string
+	row := fs.stmtGet.QueryRow(xid)
+	err := row.Scan(&media, &hash)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fs.stmtDelete.Exec(xid)
+	if err != nil {
+		return err
+	}
+	var users int64
+	row = fs.stmtHashUsers.QueryRow(hash)
+	err = row.Scan(&users)
+	if err != nil {
+		return err
+	}
+	if users == 0 {
+		err = os.Remove(fs.path(hash))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	return err
+}
+
+func (fs *fileStore) List() ([]string, error) {
+	return listxids(fs.db, "select xid from filehashes")
+}
+
+// migratemedia copies everything from one store to another, checking
+// each file after the copy. Only when all files are verified is the
+// config switched and the old copies removed.
+func migratemedia(from, to string) error {
+	if from == to {
+		return fmt.Errorf("nothing to do")
+	}
+	blobdb := openblobdb()
+	src, err := openmediastore(from, blobdb)
+	if err != nil {
+		return err
+	}
+	dst, err := openmediastore(to, blobdb)
+	if err != nil {
+		return err
+	}
+	xids, err := src.List()
+	if err != nil {
+		return err
+	}
+	ilog.Printf("migrating %d files from %s to %s", len(xids), from, to)
+	copied := 0
+	for _, xid := range xids {
+		media, data, err := loadmedia(src, xid)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", xid, err)
+		}
+		hash := hashfiledata(data)
+		if _, have, _ := dst.Open(xid); have != nil {
+			have.Close()
+		} else {
+			err = dst.Save(xid, media, hash, data)
+			if err != nil {
+				return fmt.Errorf("writing %s: %w", xid, err)
+			}
+			copied++
+		}
+		_, check, err := loadmedia(dst, xid)
+		if err != nil {
+			return fmt.Errorf("verifying %s: %w", xid, err)
+		}
+		if hashfiledata(check) != hash {
+			return fmt.Errorf("verifying %s: content mismatch", xid)
+		}
+	}
+	err = setConfigValue("mediastore", to)
+	if err != nil {
+		return err
+	}
+	for _, xid := range xids {
+		err = src.Delete(xid)
+		if err != nil {
+			return fmt.Errorf("removing old %s: %w", xid, err)
+		}
+	}
+	if from == "blob" {
+		// give the space back
+		_, err = blobdb.Exec("vacuum")
+		if err != nil {
+			elog.Printf("error vacuuming blob db: %s", err)
+		}
+	}
+	ilog.Printf("migrated %d files, %d copied, all verified", len(xids), copied)
+	return nil
+}
@@ -0,0 +1,353 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/cache"
+)
+
+// DomainPolicy is an instance wide rule for a remote server.
+// It applies to all users, and is checked before any per user filters.
+type DomainPolicy struct {
+	Host    string
+	Actions policyAction
+	Notes   string
+	Date    time.Time
+}
+
+type policyAction uint
+
+const (
+	policyReject policyAction = 1 << iota
+	policySilence
+	policyMediaStrip
+	policyNoDelivery
+	policyAllow
+	// not stored, set for hosts missing from the allowlist
+	policyUnlisted
+)
+
+var policyNames = []string{"reject", "silence", "media-strip", "no-delivery", "allow"}
+
+// ++ when set, only hosts with an allow policy may federate
+var allowlistMode = false
+
+func (pa policyAction) String() string {
+	var names []string
+	for i, name := range policyNames {
+		if pa&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func parsePolicyActions(s string) (policyAction, error) {
+	var pa policyAction
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		found := false
+		for i, n := range policyNames {
+			if n == name {
+				pa |= 1 << i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown policy action: %s", name)
+		}
+	}
+	return pa, nil
+}
+
+// the cli may change the table behind our back, so don't hold on too long
+var policycache = cache.New(cache.Options{Filler: func(host string) (policyAction, bool) {
+	var pa policyAction
+	for host != "" {
+		var actions string
+		row := stmtGetDomainPolicy.QueryRow(host)
+		err := row.Scan(&actions)
+		if err == nil {
+			a, err := parsePolicyActions(actions)
+			if err != nil {
+				elog.Printf("error in policy for %s: %s", host, err)
+			}
+			pa |= a
+		}
+		// example.com also covers sub.example.com
+		idx := strings.IndexByte(host, '.')
+		if idx == -1 {
+			break
+		}
+		host = host[idx+1:]
+	}
+	return pa, true
+}, Duration: 1 * time.Minute})
+
+// policyhost accepts either a bare hostname or a url
+func policyhost(u string) string {
+	host := u
+	if h := originate(u); h != "" {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+func hostpolicy(u string) policyAction {
+	host := policyhost(u)
+	if host == "" || host == serverName {
+		return 0
+	}
+	var pa policyAction
+	policycache.Get(host, &pa)
+	if allowlistMode && pa&(policyAllow|policyReject) == 0 {
+		pa |= policyReject | policyUnlisted
+	}
+	return pa
+}
+
+// policyRefuses checks for rejection, logging the refusal.
+func policyRefuses(u string, what string) bool {
+	pa := hostpolicy(u)
+	if pa&policyReject == 0 {
+		return false
+	}
+	host := policyhost(u)
+	if pa&policyUnlisted != 0 {
+		ilog.Printf("refusing %s for %s: not on allowlist", what, host)
+		noterefusal(host, what)
+	} else {
+		ilog.Printf("refusing %s for %s: rejected by domain policy", what, host)
+	}
+	return true
+}
+
+// policyHoldsBack checks for rejection of something we send out.
+// It's logged, but not recorded as a refusal, since nobody came asking.
+func policyHoldsBack(u string, what string) bool {
+	pa := hostpolicy(u)
+	if pa&policyReject == 0 {
+		return false
+	}
+	host := policyhost(u)
+	if pa&policyUnlisted != 0 {
+		ilog.Printf("not sending %s to %s: not on allowlist", what, host)
+	} else {
+		ilog.Printf("not sending %s to %s: rejected by domain policy", what, host)
+	}
+	return true
+}
+
+// policyUnlists is true for hosts only refused for missing from the allowlist.
+// Anybody can claim to be one, so check a signature before policyRefuses.
+func policyUnlists(u string) bool {
+	return hostpolicy(u)&policyUnlisted != 0
+}
+
+func policySilences(u string) bool {
+	return hostpolicy(u)&policySilence != 0
+}
+
+func policyStripsMedia(u string) bool {
+	return hostpolicy(u)&(policyReject|policyMediaStrip) != 0
+}
+
+func policyNoDeliver(u string) bool {
+	if hostpolicy(u)&policyNoDelivery != 0 {
+		ilog.Printf("not delivering to %s per domain policy", policyhost(u))
+		return true
+	}
+	return policyHoldsBack(u, "delivery")
+}
+
+// the user created by init administers the server
+func isadmin(userid int64) bool {
+	return userid == 1
+}
+
+// RefusedHost is a server turned away while in allowlist mode.
+type RefusedHost struct {
+	Host string
+	What string
+	Hits int64
+	Date time.Time
+}
+
+func noterefusal(host string, what string) {
+	dt := time.Now().UTC().Format(dbtimeformat)
+	res, err := stmtUpdateRefusal.Exec(what, dt, host)
+	if err == nil {
+		var n int64
+		n, err = res.RowsAffected()
+		if err == nil && n == 0 {
+			_, err = stmtSaveRefusal.Exec(host, what, dt)
+		}
+	}
+	if err != nil {
+		elog.Printf("error saving refusal for %s: %s", host, err)
+	}
+}
+
+func getRefusedHosts() []*RefusedHost {
+	rows, err := stmtGetRefusals.Query()
+	if err != nil {
+		elog.Printf("error querying refusals: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var refused []*RefusedHost
+	for rows.Next() {
+		rh := new(RefusedHost)
+		var dt string
+		err := rows.Scan(&rh.Host, &rh.What, &rh.Hits, &dt)
+		if err != nil {
+			elog.Printf("error scanning refusal: %s", err)
+			continue
+		}
+		rh.Date, _ = time.Parse(dbtimeformat, dt)
+		refused = append(refused, rh)
+	}
+	return refused
+}
+
+// allowhost adds host to the allowlist, keeping any other policy
+func allowhost(host string) error {
+	host = policyhost(host)
+	if host == "" {
+		return fmt.Errorf("no host")
+	}
+	var actions policyAction
+	notes := ""
+	for _, p := range getDomainPolicies() {
+		if p.Host == host {
+			actions = p.Actions
+			notes = p.Notes
+		}
+	}
+	err := setDomainPolicy(host, actions|policyAllow, notes)
+	if err != nil {
+		return err
+	}
+	_, err = stmtDeleteRefusal.Exec(host)
+	return err
+}
+
+func getDomainPolicies() []*DomainPolicy {
+	rows, err := stmtGetDomainPolicies.Query()
+	if err != nil {
+		elog.Printf("error querying domain policy: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var policies []*DomainPolicy
+	for rows.Next() {
+		p := new(DomainPolicy)
+		var actions, dt string
+		err := rows.Scan(&p.Host, &actions, &p.Notes, &dt)
+		if err != nil {
+			elog.Printf("error scanning domain policy: %s", err)
+			continue
+		}
+		p.Actions, _ = parsePolicyActions(actions)
+		p.Date, _ = time.Parse(dbtimeformat, dt)
+		policies = append(policies, p)
+	}
+	return policies
+}
+
+func setDomainPolicy(host string, actions policyAction, notes string) error {
+	host = strings.ToLower(host)
+	dt := time.Now().UTC().Format(dbtimeformat)
+	_, err := stmtSaveDomainPolicy.Exec(host, actions.String(), notes, dt)
+	if err != nil {
+		return err
+	}
+	policycache.Flush()
+	return nil
+}
+
+func clearDomainPolicy(host string) error {
+	host = strings.ToLower(host)
+	_, err := stmtDeleteDomainPolicy.Exec(host)
+	if err != nil {
+		return err
+	}
+	policycache.Flush()
+	return nil
+}
+
+func policyMain(args []string) {
+	usage := func() {
+		fmt.Printf("usage: honk policy list\n")
+		fmt.Printf("usage: honk policy set servername action[,action] [notes]\n")
+		fmt.Printf("usage: honk policy clear servername\n")
+		fmt.Printf("usage: honk policy refused\n")
+		fmt.Printf("actions: %s\n", strings.Join(policyNames, " "))
+	}
+	if len(args) < 1 {
+		usage()
+		return
+	}
+	switch args[0] {
+	case "list":
+		for _, p := range getDomainPolicies() {
+			fmt.Printf("%s\t%s\t%s\t%s\n", p.Host, p.Actions, p.Date.Format("2006-01-02"), p.Notes)
+		}
+	case "set":
+		if len(args) < 3 {
+			usage()
+			return
+		}
+		actions, err := parsePolicyActions(args[2])
+		if err != nil {
+			elog.Fatal(err)
+		}
+		if actions == 0 {
+			elog.Fatal("no policy actions given")
+		}
+		notes := strings.Join(args[3:], " ")
+		err = setDomainPolicy(args[1], actions, notes)
+		if err != nil {
+			elog.Fatalf("error saving policy: %s", err)
+		}
+		if actions&policyReject != 0 {
+			unplugserver(args[1])
+		}
+	case "refused":
+		for _, rh := range getRefusedHosts() {
+			fmt.Printf("%s\t%s\t%d\t%s\n", rh.Host, rh.What, rh.Hits, rh.Date.Format("2006-01-02 15:04"))
+		}
+	case "clear":
+		if len(args) < 2 {
+			usage()
+			return
+		}
+		err := clearDomainPolicy(args[1])
+		if err != nil {
+			elog.Fatalf("error clearing policy: %s", err)
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,93 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// MediaInfo is what probing learned about a file
+type MediaInfo struct {
+	Media    string
+	Width    int
+	Height   int
+	Duration Duration
+	Blurhash string
+}
+
+// probemedia looks at the content, not the name or what we were told.
+// Anything not recognized is application/octet-stream.
+func probemedia(data []byte) *MediaInfo {
+	info := &MediaInfo{Media: "application/octet-stream"}
+	ct := http.DetectContentType(data)
+	switch {
+	case ct == "application/pdf":
+		info.Media = ct
+	case strings.HasPrefix(ct, "image/"):
+		info.Media = ct
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		return probecontainer(data, probemp4)
+	case bytes.HasPrefix(data, []byte("\x1a\x45\xdf\xa3")):
+		return probecontainer(data, probewebm)
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return probecontainer(data, probeogg)
+	case bytes.HasPrefix(data, []byte("ID3")) || len(data) >= 2 && data[0] == 0xff && data[1]&0xe0 == 0xe0:
+		return probecontainer(data, probemp3)
+	case strings.HasPrefix(ct, "text/"):
+		if istext(data) {
+			info.Media = "text/plain"
+		}
+	}
+	return info
+}
+
+// probecontainer only believes audio and video that parse
+func probecontainer(data []byte, probe func([]byte) (*MediaInfo, error)) *MediaInfo {
+	info, err := probe(data)
+	if err != nil {
+		dlog.Printf("unable to probe media: %s", err)
+		return &MediaInfo{Media: "application/octet-stream"}
+	}
+	return info
+}
+
+// mediaext names uploads that came without a name
+func mediaext(media string) string {
+	switch media {
+	case "video/mp4":
+		return ".mp4"
+	case "audio/mp4":
+		return ".m4a"
+	case "audio/mpeg":
+		return ".mp3"
+	case "audio/ogg":
+		return ".ogg"
+	case "video/webm", "audio/webm":
+		return ".webm"
+	}
+	return ""
+}
+
+func istext(data []byte) bool {
+	for _, c := range data {
+		if c < 32 && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProbemedia(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		media string
+	}{
+		{name: "empty", data: nil, media: "text/plain"},
+		{name: "pdf", data: []byte("%PDF-1.4\n"), media: "application/pdf"},
+		{name: "png", data: []byte("\x89PNG\x0d\x0a\x1a\x0a"), media: "image/png"},
+		{name: "text", data: []byte("just some words\n"), media: "text/plain"},
+		{name: "html", data: []byte("<html><body>hi</body></html>"), media: "text/plain"},
+		{name: "binary", data: []byte{0, 1, 2, 3, 4}, media: "application/octet-stream"},
+		{name: "mp4", data: samplemp4(mp4trak("vide", 640, 480)), media: "video/mp4"},
+		{name: "mp4 truncated", data: samplemp4(mp4trak("vide", 640, 480))[:100], media: "application/octet-stream"},
+		{name: "mp3", data: samplemp3(0), media: "audio/mpeg"},
+		{name: "mp3 bare", data: mp3frames(2, 0), media: "audio/mpeg"},
+		{name: "mp3 truncated", data: samplemp3(0)[:300], media: "application/octet-stream"},
+		{name: "ogg", data: sampleogg(), media: "audio/ogg"},
+		{name: "ogg truncated", data: sampleogg()[:30], media: "application/octet-stream"},
+		{name: "webm", data: samplewebm(true), media: "video/webm"},
+		{name: "webm truncated", data: samplewebm(true)[:60], media: "application/octet-stream"},
+	}
+	for _, test := range tests {
+		info := probemedia(test.data)
+		if info.Media != test.media {
+			t.Errorf("%s: got %s, expected %s", test.name, info.Media, test.media)
+		}
+	}
+}
+
+func FuzzProbemedia(f *testing.F) {
+	f.Add(samplemp4(mp4trak("soun", 0, 0), mp4trak("vide", 640, 480)))
+	f.Add(samplemp3(0))
+	f.Add(samplemp3(100))
+	f.Add(sampleogg())
+	f.Add(samplewebm(true))
+	f.Add([]byte("%PDF-1.4\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info := probemedia(data)
+		if info == nil || info.Media == "" {
+			t.Fatalf("no media type for %x", data)
+		}
+		if info.Width < 0 || info.Height < 0 {
+			t.Fatalf("negative size %dx%d", info.Width, info.Height)
+		}
+	})
+}
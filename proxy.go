@@ -0,0 +1,209 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"humungus.tedunangst.com/r/webs/login"
+)
+
+// ++ megabytes of remote media to keep for the proxy
+var proxyCacheMB int64 = 100
+
+// a failed fetch isn't retried until this passes
+const proxyRetry = 10 * time.Minute
+
+// failures hold no data, but count this much toward the limit
+const proxyFailedSize = 1024
+
+type proxied struct {
+	fileid  int64
+	media   string
+	data    []byte
+	failed  time.Time
+	element *list.Element
+}
+
+// proxycache is a least recently used cache, limited by total size
+type proxycache struct {
+	sync.Mutex
+	entries map[int64]*proxied
+	order   *list.List
+	size    int64
+}
+
+var mediaproxy = &proxycache{
+	entries: make(map[int64]*proxied),
+	order:   list.New(),
+}
+
+func (pc *proxycache) limit() int64 {
+	return proxyCacheMB * 1024 * 1024
+}
+
+func (p *proxied) size() int64 {
+	if !p.failed.IsZero() {
+		return proxyFailedSize
+	}
+	return int64(len(p.data))
+}
+
+func (pc *proxycache) get(fileid int64) *proxied {
+	pc.Lock()
+	defer pc.Unlock()
+	p := pc.entries[fileid]
+	if p == nil {
+		return nil
+	}
+	if !p.failed.IsZero() && time.Since(p.failed) > proxyRetry {
+		pc.remove(p)
+		return nil
+	}
+	pc.order.MoveToFront(p.element)
+	return p
+}
+
+func (pc *proxycache) put(p *proxied) {
+	size := p.size()
+	// don't let one big file push out everything else
+	if size > pc.limit()/8 {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	if old := pc.entries[p.fileid]; old != nil {
+		pc.remove(old)
+	}
+	p.element = pc.order.PushFront(p)
+	pc.entries[p.fileid] = p
+	pc.size += size
+	for pc.size > pc.limit() {
+		last := pc.order.Back()
+		if last == nil {
+			break
+		}
+		pc.remove(last.Value.(*proxied))
+	}
+}
+
+func (pc *proxycache) remove(p *proxied) {
+	pc.order.Remove(p.element)
+	delete(pc.entries, p.fileid)
+	pc.size -= p.size()
+}
+
+// only media that can't be mistaken for a page of ours
+func proxyable(media string) bool {
+	return strings.HasPrefix(media, "image") || strings.HasPrefix(media, "video/") ||
+		strings.HasPrefix(media, "audio/")
+}
+
+func proxyfetch(fileid int64) *proxied {
+	var url, media string
+	row := stmtProxyFile.QueryRow(fileid)
+	err := row.Scan(&url, &media)
+	if err != nil {
+		return nil
+	}
+	// untyped attachments are shown as images, so treat them as such
+	if media == "" {
+		media = "image"
+	}
+	p := &proxied{fileid: fileid, media: media}
+	if !proxyable(media) || policyStripsMedia(url) {
+		p.failed = time.Now()
+		return p
+	}
+	ii, err := flightdeck.Call(url, func() (interface{}, error) {
+		return fetchsome(url)
+	})
+	if err != nil {
+		ilog.Printf("error proxying %s: %s", url, err)
+		p.failed = time.Now()
+		return p
+	}
+	data := ii.([]byte)
+	// whatever got cut off won't play, so don't pretend
+	if len(data) >= fetchLimit {
+		ilog.Printf("not proxying %s: too big", url)
+		p.failed = time.Now()
+		return p
+	}
+	if strings.HasPrefix(media, "image") {
+		img, err := shrinkit(data)
+		if err != nil {
+			ilog.Printf("unable to decode proxied image %s: %s", url, err)
+			p.failed = time.Now()
+			return p
+		}
+		data = img.Data
+		p.media = "image/" + img.Format
+	}
+	p.data = data
+	return p
+}
+
+// only files delivered to this user may be proxied for them
+func proxyallowed(userid int64, fileid int64) bool {
+	var one int
+	row := stmtProxyAllowed.QueryRow(fileid, userid, userid)
+	err := row.Scan(&one)
+	if err != nil && err != sql.ErrNoRows {
+		elog.Printf("error checking proxy file: %s", err)
+	}
+	return err == nil
+}
+
+func serveproxy(w http.ResponseWriter, r *http.Request) {
+	fileid, _ := strconv.ParseInt(mux.Vars(r)["fileid"], 10, 0)
+	u := login.GetUserInfo(r)
+	if !proxyallowed(u.UserID, fileid) {
+		http.NotFound(w, r)
+		return
+	}
+	p := mediaproxy.get(fileid)
+	if p == nil {
+		p = proxyfetch(fileid)
+		if p == nil {
+			http.NotFound(w, r)
+			return
+		}
+		mediaproxy.put(p)
+	}
+	if !p.failed.IsZero() {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", p.media)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Cache-Control", "max-age="+somedays())
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(p.data))
+}
+
+func proxyurl(fileid int64) string {
+	return fmt.Sprintf("/proxy/%d", fileid)
+}
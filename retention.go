@@ -0,0 +1,461 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetentionRule expires old remote data.
+// Original content is never removed.
+type RetentionRule struct {
+	ID     int64
+	What   string
+	Days   int64
+	Author string
+	Keep   retentionKeep
+	Date   time.Time
+}
+
+type retentionKeep uint
+
+const (
+	// honks that were saved, now always kept in their collection
+	keepSaved retentionKeep = 1 << iota
+	// threads with a local honk, usually a reply
+	keepReplied
+	// threads with a saved honk
+	keepThreads
+)
+
+var keepNames = []string{"saved", "replied", "threads"}
+
+const keepAll = keepSaved | keepReplied | keepThreads
+
+// ++ hours between retention runs
+var retentionHours int64 = 24
+
+func (rk retentionKeep) String() string {
+	var names []string
+	for i, name := range keepNames {
+		if rk&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func parseRetentionKeep(s string) (retentionKeep, error) {
+	var rk retentionKeep
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		found := false
+		for i, n := range keepNames {
+			if n == name {
+				rk |= 1 << i
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown retention exception: %s", name)
+		}
+	}
+	return rk, nil
+}
+
+func (rule *RetentionRule) String() string {
+	s := fmt.Sprintf("%s older than %d days", rule.What, rule.Days)
+	if rule.Author != "" {
+		s += " by " + rule.Author
+	}
+	if rule.Keep != 0 {
+		s += " except " + rule.Keep.String()
+	}
+	return s
+}
+
+// where selects the remote honks covered by the rule
+func (rule *RetentionRule) where() (string, []interface{}) {
+	var args []interface{}
+	expdate := time.Now().Add(-time.Duration(rule.Days) * 24 * time.Hour).UTC().Format(dbtimeformat)
+	// collections are always kept
+	where := "whofore = 0 and dt < ? and honkid not in (select honkid from collected)"
+	args = append(args, expdate)
+	if rule.Author != "" {
+		where += " and author = ?"
+		args = append(args, rule.Author)
+	}
+	if rule.Keep&keepReplied != 0 {
+		where += " and thread not in (select thread from honks where whofore = 2 or whofore = 3)"
+	}
+	if rule.Keep&keepThreads != 0 {
+		where += " and thread not in (select thread from honks where honkid in (select honkid from collected))"
+	}
+	return where, args
+}
+
+// RetentionRun records what one pass of the rules removed.
+type RetentionRun struct {
+	Date    time.Time
+	Honks   int64
+	Files   int64
+	Blobs   int64
+	Details string
+}
+
+func (run *RetentionRun) String() string {
+	return fmt.Sprintf("removed %d honks, %d media files, %d blobs", run.Honks, run.Files, run.Blobs)
+}
+
+func execcount(db *sql.DB, q string, args ...interface{}) (int64, error) {
+	res, err := db.Exec(q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// applyrule removes what the rule says, returning how many honks or files
+func applyrule(db *sql.DB, rule *RetentionRule) (int64, error) {
+	where, args := rule.where()
+	switch rule.What {
+	case "honks":
+		return execcount(db, "delete from honks where "+where, args...)
+	case "media":
+		// forget our copy, the attachment still links to the original
+		args = append(args, fmt.Sprintf("https://%s/%%", serverName))
+		return execcount(db, "update filemeta set local = 0 where local = 1 and fileid in (select fileid from attachments where honkid in (select honkid from honks where "+where+")) and url not like ?", args...)
+	}
+	return 0, fmt.Errorf("unknown retention target: %s", rule.What)
+}
+
+// unattached files are kept this long, in case a post is still coming
+const sweepGrace = 7 * 24 * time.Hour
+
+// fileLock is held for reading while a saved file has no filemeta yet,
+// and for writing while the sweep decides what is unused.
+var fileLock sync.RWMutex
+
+// sweepdb removes anything no longer referenced by a honk
+func sweepdb(db *sql.DB) (int64, int64, error) {
+	orphans := []string{
+		"delete from attachments where honkid > 0 and honkid not in (select honkid from honks)",
+		"delete from hashtags where honkid not in (select honkid from honks)",
+		"delete from honkmeta where honkid not in (select honkid from honks)",
+		"delete from honksearch where rowid not in (select honkid from honks)",
+		"delete from collected where honkid not in (select honkid from honks)",
+	}
+	for _, q := range orphans {
+		_, err := db.Exec(q)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	// drafts keep their attachments too
+	keep, err := draftfiles(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	fileLock.Lock()
+	defer fileLock.Unlock()
+	files, err := sweepfilemeta(db, keep)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, u := range allusers() {
+		_, err = db.Exec("delete from actions where userid = ? and action = 'mute-thread' and actionID < (select actionID from actions where userid = ? and action = 'mute-thread' order by actionID desc limit 1 offset 200)", u.UserID, u.UserID)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	inuse := make(map[string]bool)
+	rows, err := db.Query("select xid from filemeta where local = 1")
+	if err != nil {
+		return 0, 0, err
+	}
+	for rows.Next() {
+		var xid string
+		err = rows.Scan(&xid)
+		if err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		inuse[xid] = true
+	}
+	rows.Close()
+	xids, err := mediaStore.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	var blobs int64
+	for _, xid := range xids {
+		// renditions go with their original
+		if inuse[xid] || inuse[basexid(xid)] {
+			continue
+		}
+		err = mediaStore.Delete(xid)
+		if err != nil {
+			return 0, 0, err
+		}
+		blobs++
+	}
+	return files, blobs, nil
+}
+
+// sweepfilemeta removes unattached files past the grace period, except keep.
+// There may be too many to pass as arguments, so they go in a temp table,
+// all in one transaction to stay on the connection that has it.
+func sweepfilemeta(db *sql.DB, keep map[string]bool) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("create temp table keepfiles (xid text)")
+	if err != nil {
+		return 0, err
+	}
+	for xid := range keep {
+		_, err = tx.Exec("insert into temp.keepfiles (xid) values (?)", xid)
+		if err != nil {
+			return 0, err
+		}
+	}
+	expdate := time.Now().Add(-sweepGrace).UTC().Format(dbtimeformat)
+	res, err := tx.Exec("delete from filemeta where fileid not in (select fileid from attachments) and dt < ? and xid not in (select xid from temp.keepfiles)", expdate)
+	if err != nil {
+		return 0, err
+	}
+	files, _ := res.RowsAffected()
+	_, err = tx.Exec("drop table temp.keepfiles")
+	if err != nil {
+		return 0, err
+	}
+	return files, tx.Commit()
+}
+
+var retentionLock sync.Mutex
+
+func runretention(rules []*RetentionRule) (*RetentionRun, error) {
+	retentionLock.Lock()
+	defer retentionLock.Unlock()
+	db := opendatabase()
+	run := new(RetentionRun)
+	run.Date = time.Now().UTC()
+	var details []string
+	for _, rule := range rules {
+		n, err := applyrule(db, rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", rule.ID, err)
+		}
+		details = append(details, fmt.Sprintf("%s: %d", rule, n))
+		if rule.What == "honks" {
+			run.Honks += n
+		} else {
+			run.Files += n
+		}
+	}
+	files, blobs, err := sweepdb(db)
+	if err != nil {
+		return nil, err
+	}
+	run.Files += files
+	run.Blobs = blobs
+	run.Details = strings.Join(details, "\n")
+	_, err = stmtSaveRetentionRun.Exec(run.Date.Format(dbtimeformat), run.Honks, run.Files, run.Blobs, run.Details)
+	if err != nil {
+		elog.Printf("error saving retention run: %s", err)
+	}
+	return run, nil
+}
+
+func retentionloop() {
+	time.Sleep(10 * time.Minute)
+	for {
+		rules := getRetentionRules()
+		if len(rules) > 0 {
+			run, err := runretention(rules)
+			if err != nil {
+				elog.Printf("error running retention: %s", err)
+			} else {
+				ilog.Printf("retention %s", run)
+			}
+		}
+		hours := retentionHours
+		if hours < 1 {
+			hours = 1
+		}
+		time.Sleep(time.Duration(hours) * time.Hour)
+	}
+}
+
+func getRetentionRules() []*RetentionRule {
+	rows, err := stmtGetRetentionRules.Query()
+	if err != nil {
+		elog.Printf("error querying retention rules: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var rules []*RetentionRule
+	for rows.Next() {
+		rule := new(RetentionRule)
+		var keep, dt string
+		err := rows.Scan(&rule.ID, &rule.What, &rule.Days, &rule.Author, &keep, &dt)
+		if err != nil {
+			elog.Printf("error scanning retention rule: %s", err)
+			continue
+		}
+		rule.Keep, _ = parseRetentionKeep(keep)
+		rule.Date, _ = time.Parse(dbtimeformat, dt)
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func getRetentionRuns(limit int) []*RetentionRun {
+	rows, err := stmtGetRetentionRuns.Query(limit)
+	if err != nil {
+		elog.Printf("error querying retention runs: %s", err)
+		return nil
+	}
+	defer rows.Close()
+	var runs []*RetentionRun
+	for rows.Next() {
+		run := new(RetentionRun)
+		var dt string
+		err := rows.Scan(&dt, &run.Honks, &run.Files, &run.Blobs, &run.Details)
+		if err != nil {
+			elog.Printf("error scanning retention run: %s", err)
+			continue
+		}
+		run.Date, _ = time.Parse(dbtimeformat, dt)
+		runs = append(runs, run)
+	}
+	return runs
+}
+
+// cleanupdb is the old one shot cleanup, by days or by author
+func cleanupdb(arg string) {
+	rule := &RetentionRule{What: "honks"}
+	days, err := strconv.Atoi(arg)
+	if err != nil {
+		rule.Author = arg
+		rule.Days = 3
+		rule.Keep = keepSaved
+	} else {
+		rule.Days = int64(days)
+		rule.Keep = keepAll
+	}
+	run, err := runretention([]*RetentionRule{rule})
+	if err != nil {
+		elog.Fatal(err)
+	}
+	fmt.Printf("%s\n", run)
+}
+
+func retentionMain(args []string) {
+	usage := func() {
+		fmt.Printf("usage: honk retention list\n")
+		fmt.Printf("usage: honk retention add honks|media days [author=url] [keep=exception,...]\n")
+		fmt.Printf("usage: honk retention del ruleid\n")
+		fmt.Printf("usage: honk retention run\n")
+		fmt.Printf("usage: honk retention report\n")
+		fmt.Printf("exceptions: %s none (default all)\n", strings.Join(keepNames, " "))
+	}
+	if len(args) < 1 {
+		usage()
+		return
+	}
+	switch args[0] {
+	case "list":
+		for _, rule := range getRetentionRules() {
+			fmt.Printf("%d\t%s\n", rule.ID, rule)
+		}
+	case "add":
+		if len(args) < 3 {
+			usage()
+			return
+		}
+		rule := &RetentionRule{What: args[1], Keep: keepAll}
+		if rule.What != "honks" && rule.What != "media" {
+			elog.Fatalf("unknown retention target: %s", rule.What)
+		}
+		days, err := strconv.ParseInt(args[2], 10, 0)
+		if err != nil || days < 1 {
+			elog.Fatalf("bad days: %s", args[2])
+		}
+		rule.Days = days
+		for _, a := range args[3:] {
+			switch {
+			case strings.HasPrefix(a, "author="):
+				rule.Author = a[7:]
+			case strings.HasPrefix(a, "keep="):
+				rule.Keep, err = parseRetentionKeep(a[5:])
+				if err != nil {
+					elog.Fatal(err)
+				}
+			default:
+				usage()
+				return
+			}
+		}
+		dt := time.Now().UTC().Format(dbtimeformat)
+		_, err = stmtSaveRetentionRule.Exec(rule.What, rule.Days, rule.Author, rule.Keep.String(), dt)
+		if err != nil {
+			elog.Fatalf("error saving retention rule: %s", err)
+		}
+	case "del":
+		if len(args) < 2 {
+			usage()
+			return
+		}
+		ruleid, _ := strconv.ParseInt(args[1], 10, 0)
+		_, err := stmtDeleteRetentionRule.Exec(ruleid)
+		if err != nil {
+			elog.Fatalf("error deleting retention rule: %s", err)
+		}
+	case "run":
+		rules := getRetentionRules()
+		if len(rules) == 0 {
+			fmt.Printf("no retention rules\n")
+			return
+		}
+		run, err := runretention(rules)
+		if err != nil {
+			elog.Fatal(err)
+		}
+		fmt.Printf("%s\n%s\n", run, run.Details)
+	case "report":
+		for _, run := range getRetentionRuns(10) {
+			fmt.Printf("%s\t%s\n", run.Date.Format("2006-01-02 15:04"), run)
+			if run.Details != "" {
+				fmt.Printf("\t%s\n", strings.ReplaceAll(run.Details, "\n", "\n\t"))
+			}
+		}
+	default:
+		usage()
+	}
+}
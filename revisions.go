@@ -0,0 +1,141 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Revision is one version of a honk on the history page.
+// Date is when it was replaced, and zero for the current version.
+type Revision struct {
+	Date       time.Time
+	Current    bool
+	PrecisDiff template.HTML
+	TextDiff   template.HTML
+}
+
+var re_difftokens = regexp.MustCompile(`\s+|[^\s]+`)
+
+// give up on the word diff past this many comparisons
+const maxDiffWork = 4 * 1024 * 1024
+
+// wordiff marks up the changes from a to b with del and ins.
+func wordiff(a, b string) template.HTML {
+	if a == b {
+		return template.HTML(html.EscapeString(b))
+	}
+	at := re_difftokens.FindAllString(a, -1)
+	bt := re_difftokens.FindAllString(b, -1)
+	var buf strings.Builder
+	del := func(s string) {
+		// removed spacing is just noise
+		if strings.TrimSpace(s) == "" {
+			return
+		}
+		buf.WriteString("<del>" + html.EscapeString(s) + "</del>")
+	}
+	ins := func(s string) {
+		if strings.TrimSpace(s) == "" {
+			buf.WriteString(html.EscapeString(s))
+			return
+		}
+		buf.WriteString("<ins>" + html.EscapeString(s) + "</ins>")
+	}
+	if len(at)*len(bt) > maxDiffWork {
+		del(a)
+		ins(b)
+		return template.HTML(buf.String())
+	}
+	// lcs[i][j] is the common length of at[i:] and bt[j:]
+	lcs := make([][]int, len(at)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bt)+1)
+	}
+	for i := len(at) - 1; i >= 0; i-- {
+		for j := len(bt) - 1; j >= 0; j-- {
+			if at[i] == bt[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(at) && j < len(bt) {
+		if at[i] == bt[j] {
+			buf.WriteString(html.EscapeString(at[i]))
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			del(at[i])
+			i++
+		} else {
+			ins(bt[j])
+			j++
+		}
+	}
+	del(strings.Join(at[i:], ""))
+	ins(strings.Join(bt[j:], ""))
+	return template.HTML(buf.String())
+}
+
+func revisiontext(text, format string) string {
+	if format == "html" {
+		return strings.TrimSpace(searchtext(text))
+	}
+	return text
+}
+
+// honkrevisions lists the versions of a honk, newest first,
+// each compared to the one before it.
+func honkrevisions(h *ActivityPubActivity) []Revision {
+	type version struct {
+		precis, text string
+		date         time.Time
+	}
+	var versions []version
+	for _, rev := range h.Revisions {
+		format := rev.Format
+		if format == "" {
+			format = h.Format
+		}
+		versions = append(versions, version{rev.Precis, revisiontext(rev.Text, format), rev.Date})
+	}
+	versions = append(versions, version{h.Precis, revisiontext(h.Text, h.Format), time.Time{}})
+
+	var revs []Revision
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		rev := Revision{Date: v.date, Current: i == len(versions)-1}
+		if i == 0 {
+			rev.PrecisDiff = template.HTML(html.EscapeString(v.precis))
+			rev.TextDiff = template.HTML(html.EscapeString(v.text))
+		} else {
+			prev := versions[i-1]
+			rev.PrecisDiff = wordiff(prev.precis, v.precis)
+			rev.TextDiff = wordiff(prev.text, v.text)
+		}
+		revs = append(revs, rev)
+	}
+	return revs
+}
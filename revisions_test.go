@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWordiff(t *testing.T) {
+	tests := []struct {
+		a, b, out string
+	}{
+		{a: "", b: "", out: ""},
+		{a: "same words", b: "same words", out: "same words"},
+		{a: "", b: "new", out: "<ins>new</ins>"},
+		{a: "old", b: "", out: "<del>old</del>"},
+		{a: "the quick fox", b: "the slow fox", out: "the <del>quick</del><ins>slow</ins> fox"},
+		{a: "one two", b: "one two three", out: "one two<ins> three</ins>"},
+		{a: "one two three", b: "one three", out: "one <del>two</del>three"},
+		{a: "a  b", b: "a b", out: "a b"},
+		{a: "x < y", b: "x > y", out: "x <del>&lt;</del><ins>&gt;</ins> y"},
+	}
+	for _, test := range tests {
+		if out := string(wordiff(test.a, test.b)); out != test.out {
+			t.Errorf("%q -> %q: got %q, expected %q", test.a, test.b, out, test.out)
+		}
+	}
+}
+
+func TestWordiffLimit(t *testing.T) {
+	a := strings.Repeat("honk ", 1500) + "end"
+	b := strings.Repeat("honk ", 1500) + "fin"
+	if n := len(re_difftokens.FindAllString(a, -1)); n*n <= maxDiffWork {
+		t.Fatalf("only %d tokens, not over the limit", n)
+	}
+	out := string(wordiff(a, b))
+	if out != "<del>"+a+"</del><ins>"+b+"</ins>" {
+		t.Errorf("expected a whole replacement, got %.80q", out)
+	}
+	short := string(wordiff("honk end", "honk fin"))
+	if short != "honk <del>end</del><ins>fin</ins>" {
+		t.Errorf("got %q", short)
+	}
+}
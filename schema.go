@@ -18,6 +18,8 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"strings"
 
 	"github.com/dottedmag/sqv"
 )
@@ -189,6 +191,116 @@ create table auth (
 );
 CREATE index idxauth_userid on auth(userid);
 CREATE index idxauth_hash on auth(hash);
+`,
+	`
+create table domainpolicy (
+  policyid integer primary key,
+  host text,
+  actions text,
+  notes text,
+  dt text
+);
+create unique index idx_domainpolicyhost on domainpolicy(host);
+`,
+	`
+create table refusals (
+  host text,
+  what text,
+  hits integer,
+  dt text
+);
+create unique index idx_refusalshost on refusals(host);
+`,
+	`
+create table filterstats (
+  hfcsid integer primary key,
+  hits integer,
+  dt text,
+  samples text
+);
+`,
+	`
+create table filtersubs (
+  userid integer,
+  owner integer
+);
+create index idx_filtersubsuser on filtersubs(userid);
+create index idx_filtersubsowner on filtersubs(owner);
+`,
+	`
+create virtual table honksearch using fts5(
+  text,
+  precis,
+  descs,
+  tokenize = 'unicode61 remove_diacritics 2'
+);
+`,
+	`
+create table retention (
+  ruleid integer primary key,
+  what text,
+  days integer,
+  author text,
+  keep text,
+  dt text
+);
+
+create table retentionruns (
+  runid integer primary key,
+  dt text,
+  honks integer,
+  files integer,
+  blobs integer,
+  details text
+);
+`,
+	`
+alter table filemeta add column blurhash text default '';
+alter table filemeta add column width integer default 0;
+alter table filemeta add column height integer default 0;
+`,
+	`
+alter table filemeta add column duration integer default 0;
+`,
+	`
+create table drafts (
+  draftid integer primary key,
+  userid integer,
+  dt text,
+  json text
+);
+create index idx_draftsuserid on drafts(userid);
+`,
+	`
+create table collections (
+  collectionid integer primary key,
+  userid integer,
+  name text,
+  notes text,
+  dt text
+);
+create index idx_collectionsuserid on collections(userid);
+create table collected (
+  collectionid integer,
+  honkid integer,
+  added text
+);
+create index idx_collectedid on collected(collectionid);
+create index idx_collectedhonkid on collected(honkid);
+`,
+	`
+create index idx_attachmentsfileid on attachments(fileid);
+`,
+	`
+alter table filemeta add column dt text default '';
+`,
+	`
+insert into collections (userid, name, notes, dt) select distinct userid, 'saved', '', datetime('now') from honks where flags & 4 and userid not in (select userid from collections where name = 'saved');
+insert into collected (collectionid, honkid, added) select collections.collectionid, honks.honkid, datetime('now') from honks join collections on collections.userid = honks.userid and collections.name = 'saved' where honks.flags & 4 and honks.honkid not in (select honkid from collected where collected.collectionid = collections.collectionid);
+update honks set flags = flags & ~4 where flags & 4;
+`,
+	`
+delete from refusals where what in ('delivery', 'fetch');
 `,
 }
 
@@ -203,9 +315,42 @@ create table filedata (
 create index idx_filexid on filedata(xid);
 create index idx_filehash on filedata(hash);
 `,
+	`
+create table filehashes (
+  xid text,
+  media text,
+  hash text
+);
+create index idx_filehashesxid on filehashes(xid);
+create index idx_filehasheshash on filehashes(hash);
+`,
+}
+
+var errNoFTS5 = errors.New("sqlite was built without fts5, which search requires")
+
+// checkFTS5 makes sure the sqlite library can build the search index
+// before a migration half fails trying.
+func checkFTS5(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "create virtual table temp.ftscheck using fts5(text)")
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module") {
+			return errNoFTS5
+		}
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "drop table temp.ftscheck")
+	return err
 }
 
 func upgradeDB(ctx context.Context, db *sql.DB) error {
+	if err := checkFTS5(ctx, db); err != nil {
+		return err
+	}
 	return sqv.Apply(ctx, db, honkAppID, schema)
 }
 
@@ -0,0 +1,289 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"humungus.tedunangst.com/r/webs/htfilter"
+)
+
+const searchPageSize = 50
+
+func searchtext(s string) string {
+	var htf htfilter.Filter
+	t, err := htf.TextOnly(s)
+	if err != nil {
+		return s
+	}
+	return t
+}
+
+// searchindex updates the full text index for a honk.
+// The attachments must already be saved in the same transaction.
+func searchindex(tx *sql.Tx, h *ActivityPubActivity) error {
+	var descs []string
+	rows, err := tx.Stmt(stmtHonkFileDescs).Query(h.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var desc string
+		err = rows.Scan(&desc)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		descs = append(descs, desc)
+	}
+	rows.Close()
+	_, err = tx.Stmt(stmtDeleteSearch).Exec(h.ID)
+	if err == nil {
+		_, err = tx.Stmt(stmtSaveSearch).Exec(h.ID, searchtext(h.Text), searchtext(h.Precis),
+			strings.Join(descs, " "))
+	}
+	return err
+}
+
+// buildsearchindex indexes honks saved before the index existed
+func buildsearchindex() {
+	var done int64
+	getConfigValue("searchindexed", &done)
+	if done != 0 {
+		return
+	}
+	ilog.Printf("building search index")
+	db := opendatabase()
+	var lastid int64
+	count := 0
+	for {
+		rows, err := db.Query("select honkid, text, precis from honks where honkid > ? order by honkid limit 500", lastid)
+		if err != nil {
+			elog.Printf("error querying honks for index: %s", err)
+			return
+		}
+		var honks []*ActivityPubActivity
+		for rows.Next() {
+			h := new(ActivityPubActivity)
+			err = rows.Scan(&h.ID, &h.Text, &h.Precis)
+			if err != nil {
+				elog.Printf("error scanning honk for index: %s", err)
+				continue
+			}
+			honks = append(honks, h)
+		}
+		rows.Close()
+		if len(honks) == 0 {
+			break
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			elog.Printf("can't begin tx: %s", err)
+			return
+		}
+		for _, h := range honks {
+			err = searchindex(tx, h)
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
+		if err != nil {
+			elog.Printf("error building search index: %s", err)
+			return
+		}
+		lastid = honks[len(honks)-1].ID
+		count += len(honks)
+	}
+	setConfigValue("searchindexed", 1)
+	ilog.Printf("search index built with %d honks", count)
+}
+
+// searchwords splits a query into words, keeping "quoted phrases" together.
+func searchwords(q string) []string {
+	var words []string
+	var word strings.Builder
+	quoted := false
+	for _, c := range q {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			word.WriteRune(c)
+		case !quoted && (c == ' ' || c == '\t'):
+			if word.Len() > 0 {
+				words = append(words, word.String())
+				word.Reset()
+			}
+		default:
+			word.WriteRune(c)
+		}
+	}
+	if word.Len() > 0 {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// ftsphrase quotes a word or phrase so fts5 doesn't see operators.
+// A trailing * does prefix matching.
+func ftsphrase(t string) string {
+	prefix := false
+	if strings.HasSuffix(t, "*") && !strings.HasSuffix(t, "\"*") {
+		prefix = true
+		t = t[:len(t)-1]
+	}
+	t = strings.Trim(t, "\"")
+	if t == "" {
+		return ""
+	}
+	t = "\"" + strings.ReplaceAll(t, "\"", "\"\"") + "\""
+	if prefix {
+		t += "*"
+	}
+	return t
+}
+
+func searchdate(s string) (string, bool) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return "", false
+	}
+	return t.UTC().Format(dbtimeformat), true
+}
+
+func gethonksbysearch(userid int64, q string, page int) []*ActivityPubActivity {
+	var queries []string
+	var params []interface{}
+	queries = append(queries, "honks.userid = ?")
+	params = append(params, userid)
+
+	var matches, nomatches []string
+	for _, t := range searchwords(q) {
+		negate := " "
+		if t[0] == '-' {
+			t = t[1:]
+			negate = " not "
+		}
+		if t == "" {
+			continue
+		}
+		key, val := "", t
+		if t[0] != '"' {
+			if idx := strings.IndexByte(t, ':'); idx != -1 {
+				key, val = t[:idx], t[idx+1:]
+			}
+		}
+		switch key {
+		case "site":
+			site := "%" + val + "%"
+			queries = append(queries, "honks.xid"+negate+"like ?")
+			params = append(params, site)
+			continue
+		case "author":
+			author := val
+			xid := fullname(author, userid)
+			if xid != "" {
+				author = xid
+			}
+			queries = append(queries, negate+"(honks.author = ? or honks.oonker = ?)")
+			params = append(params, author)
+			params = append(params, author)
+			continue
+		case "before", "after":
+			dt, ok := searchdate(val)
+			if !ok {
+				break
+			}
+			op := " < ?"
+			if key == "after" {
+				op = " > ?"
+			}
+			queries = append(queries, negate+"(honks.dt"+op+")")
+			params = append(params, dt)
+			continue
+		case "has":
+			if val == "media" {
+				queries = append(queries, negate+"exists (select 1 from attachments where attachments.honkid = honks.honkid)")
+				continue
+			}
+		case "is":
+			if val == "reply" {
+				queries = append(queries, negate+"(honks.inReplyToID <> '')")
+				continue
+			}
+		case "tag":
+			tag := strings.ToLower(val)
+			if tag == "" {
+				continue
+			}
+			if tag[0] != '#' {
+				tag = "#" + tag
+			}
+			queries = append(queries, "honks.honkid"+negate+"in (select honkid from hashtags where tag = ?)")
+			params = append(params, tag)
+			continue
+		case "from":
+			if val == "me" {
+				var user *UserProfile
+				if usersCacheByID.Get(userid, &user) {
+					queries = append(queries, negate+"(honks.author = ?)")
+					params = append(params, user.URL)
+				}
+				continue
+			}
+		}
+		phrase := ftsphrase(t)
+		if phrase == "" {
+			continue
+		}
+		if negate == " not " {
+			nomatches = append(nomatches, phrase)
+		} else {
+			matches = append(matches, phrase)
+		}
+	}
+
+	selecthonks := "select honks.honkid, honks.userid, username, what, author, oonker, honks.xid, inReplyToID, dt, url, audience, text, precis, format, thread, whofore, flags from honks join users on honks.userid = users.userid "
+	order := " order by honks.honkid desc"
+	if len(matches) > 0 {
+		match := strings.Join(matches, " ")
+		if len(nomatches) > 0 {
+			match = "(" + match + ") NOT (" + strings.Join(nomatches, " OR ") + ")"
+		}
+		selecthonks += "join honksearch on honksearch.rowid = honks.honkid "
+		queries = append(queries, "honksearch match ?")
+		params = append(params, match)
+		// precis counts a little more, attachment descriptions a little less
+		order = " order by bm25(honksearch, 1.0, 2.0, 0.5), honks.honkid desc"
+	} else if len(nomatches) > 0 {
+		queries = append(queries, "honks.honkid not in (select rowid from honksearch where honksearch match ?)")
+		params = append(params, strings.Join(nomatches, " OR "))
+	}
+	where := "where " + strings.Join(queries, " and ")
+	butnotthose := " and thread not in (select object from actions where userid = ? and action = 'mute-thread' order by actionID desc limit 100)"
+	params = append(params, userid)
+	limit := " limit ? offset ?"
+	params = append(params, searchPageSize, page*searchPageSize)
+	rows, err := opendatabase().Query(selecthonks+where+butnotthose+order+limit, params...)
+	honks := getsomehonks(rows, err)
+	return honks
+}
@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2019 Ted Unangst <tedu@tedunangst.com>
+//
+// Permission to use, copy, modify, and distribute this software for any
+// purpose with or without fee is hereby granted, provided that the above
+// copyright notice and this permission notice appear in all copies.
+//
+// THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+// WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+// MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+// ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+// WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+// ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+// OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+
+package main
+
+// ThreadNode is one honk in the reply tree of a thread.
+// Missing nodes stand in for ancestors we don't have.
+type ThreadNode struct {
+	XID       string
+	Honk      *ActivityPubActivity `json:",omitempty"`
+	Missing   bool                 `json:",omitempty"`
+	Highlight bool                 `json:",omitempty"`
+	Count     int
+	Replies   []*ThreadNode `json:",omitempty"`
+	parent    *ThreadNode
+}
+
+// threadtree arranges honks by InReplyToID, in the order given,
+// which should be oldest first. The honk from is highlighted.
+func threadtree(honks []*ActivityPubActivity, from string) []*ThreadNode {
+	nodes := make(map[string]*ThreadNode)
+	var order []*ThreadNode
+	for _, h := range honks {
+		if nodes[h.XID] != nil {
+			continue
+		}
+		node := &ThreadNode{XID: h.XID, Honk: h, Highlight: h.XID == from}
+		nodes[h.XID] = node
+		order = append(order, node)
+	}
+	var roots []*ThreadNode
+	for _, node := range order {
+		parentid := node.Honk.InReplyToID
+		if parentid == "" {
+			roots = append(roots, node)
+			continue
+		}
+		parent := nodes[parentid]
+		if parent == nil {
+			parent = &ThreadNode{XID: parentid, Missing: true}
+			nodes[parentid] = parent
+			roots = append(roots, parent)
+		}
+		// refuse to close a loop
+		loop := false
+		for p := parent; p != nil; p = p.parent {
+			if p == node {
+				loop = true
+				break
+			}
+		}
+		if loop {
+			roots = append(roots, node)
+			continue
+		}
+		node.parent = parent
+		parent.Replies = append(parent.Replies, node)
+	}
+	for _, node := range roots {
+		threadcount(node)
+	}
+	return roots
+}
+
+func threadcount(node *ThreadNode) int {
+	node.Count = 0
+	for _, r := range node.Replies {
+		node.Count += 1 + threadcount(r)
+	}
+	return node.Count
+}
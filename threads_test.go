@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// threadshape writes a tree as xid(replies...), with ? for missing
+// nodes, * for the highlight, and the count after a slash.
+func threadshape(nodes []*ThreadNode) string {
+	var parts []string
+	for _, n := range nodes {
+		s := n.XID
+		if n.Missing {
+			s = "?" + s
+		}
+		if n.Highlight {
+			s += "*"
+		}
+		if n.Count > 0 {
+			s += fmt.Sprintf("/%d", n.Count)
+		}
+		if len(n.Replies) > 0 {
+			s += "(" + threadshape(n.Replies) + ")"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestThreadtree(t *testing.T) {
+	tests := []struct {
+		name  string
+		honks string // xid:inreplyto, oldest first
+		from  string
+		shape string
+	}{
+		{name: "empty", shape: ""},
+		{name: "single", honks: "a:", from: "a", shape: "a*"},
+		{name: "chain", honks: "a: b:a c:b", from: "c", shape: "a/2(b/1(c*))"},
+		{name: "branches", honks: "a: b:a c:a d:b", from: "a", shape: "a*/3(b/1(d) c)"},
+		{name: "missing parent", honks: "b:a c:b d:a", from: "d", shape: "?a/3(b/1(c) d*)"},
+		{name: "missing parents", honks: "b:a c:x", shape: "?a/1(b) ?x/1(c)"},
+		{name: "reply before parent", honks: "b:a a:", shape: "a/1(b)"},
+		{name: "duplicate", honks: "a: b:a b:a", shape: "a/1(b)"},
+		{name: "self reply", honks: "a:a b:a", shape: "a/1(b)"},
+		{name: "cycle", honks: "a:b b:a", shape: "b/1(a)"},
+		{name: "long cycle", honks: "a:c b:a c:b d:c", shape: "c/3(a/1(b) d)"},
+		{name: "two roots", honks: "a: b: c:b", shape: "a b/1(c)"},
+	}
+	for _, test := range tests {
+		var honks []*ActivityPubActivity
+		for _, f := range strings.Fields(test.honks) {
+			xid, parent, _ := strings.Cut(f, ":")
+			honks = append(honks, &ActivityPubActivity{XID: xid, InReplyToID: parent})
+		}
+		if shape := threadshape(threadtree(honks, test.from)); shape != test.shape {
+			t.Errorf("%s: got %q, expected %q", test.name, shape, test.shape)
+		}
+	}
+}
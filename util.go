@@ -162,7 +162,11 @@ func deluser(username string) {
 	sqlMustQuery(db, "delete from actions where userid = ?", userid)
 	sqlMustQuery(db, "delete from resubmissions where userid = ?", userid)
 	sqlMustQuery(db, "delete from hfcs where userid = ?", userid)
+	sqlMustQuery(db, "delete from filtersubs where userid = ? or owner = ?", userid, userid)
 	sqlMustQuery(db, "delete from auth where userid = ?", userid)
+	sqlMustQuery(db, "delete from drafts where userid = ?", userid)
+	sqlMustQuery(db, "delete from collected where collectionid in (select collectionid from collections where userid = ?)", userid)
+	sqlMustQuery(db, "delete from collections where userid = ?", userid)
 	sqlMustQuery(db, "delete from users where userid = ?", userid)
 }
 
@@ -68,8 +68,44 @@ function flogit(el, how, xid) {
 	el.disabled = true
 	post("/zonkit", encode({"CSRF": csrftoken, "action": how, "what": xid}))
 }
+function collecthonk(el, xid) {
+	var name = prompt("collection")
+	if (!name) {
+		return false
+	}
+	el.innerHTML = "collected"
+	el.disabled = true
+	post("/zonkit", encode({"CSRF": csrftoken, "action": "collect", "what": xid}) +
+		"&collection=" + encodeURIComponent(name))
+	return false
+}
+function uncollecthonk(el, xid, name) {
+	el.innerHTML = "uncollected"
+	el.disabled = true
+	post("/zonkit", encode({"CSRF": csrftoken, "action": "uncollect", "what": xid}) +
+		"&collection=" + encodeURIComponent(name))
+	return false
+}
+function altedit(el, xid) {
+	var s = [encode({"CSRF": csrftoken, "action": "altedit", "what": xid})]
+	var inputs = el.parentElement.parentElement.querySelectorAll("input[data-xid]")
+	for (var i = 0; i < inputs.length; i++) {
+		s.push("attachmentXid=" + encodeURIComponent(inputs[i].getAttribute("data-xid")))
+		s.push("attachmentDesc=" + encodeURIComponent(inputs[i].value))
+	}
+	el.innerHTML = "saved"
+	el.disabled = true
+	post("/zonkit", s.join("&"))
+	return false
+}
 
 var lehonkform = document.getElementById("honkform")
+if (lehonkform)
+	lehonkform.addEventListener("submit", function() {
+		clearTimeout(drafttimer)
+		if (draftxhr)
+			draftxhr.abort()
+	})
 var lehonkbutton = document.getElementById("honkingtime")
 
 function oldestnewest(btn) {
@@ -85,10 +121,15 @@ function removeglow() {
 	}
 }
 
-function fillinhonks(xhr, glowit) {
+function fillinhonks(xhr, glowit, older) {
 	var resp = xhr.response
 	var stash = curpagestate.name + ":" + curpagestate.arg
-	tophid[stash] = resp.Tophid
+	if (!older) {
+		tophid[stash] = resp.Tophid
+	}
+	if (older || !(stash in bothid)) {
+		bothid[stash] = resp.Bothid
+	}
 	var doc = document.createElement( 'div' );
 	doc.innerHTML = resp.Srvmsg
 	var srvmsg = doc
@@ -123,6 +164,17 @@ function fillinhonks(xhr, glowit) {
 	var honksonpage = document.getElementById("honksonpage")
 	var holder = honksonpage.children[0]
 	var lenhonks = honks.length
+	if (older) {
+		// older honks go on the other end
+		while (honks.length) {
+			var h = honks[0]
+			if (frontload) {
+				holder.append(h)
+			} else {
+				holder.prepend(h)
+			}
+		}
+	}
 	for (var i = honks.length; i > 0; i--) {
 		var h = honks[i-1]
 		if (glowit)
@@ -144,6 +196,8 @@ function hydrargs() {
 		args["c"] = arg
 	} else if (name == "combo") {
 		args["c"] = arg
+	} else if (name == "hashtag") {
+		args["c"] = arg
 	} else if (name == "author") {
 		args["xid"] = arg
 	} else if (name == "user") {
@@ -179,6 +233,41 @@ function refreshhonks(btn) {
 		refreshupdate(" timed out")
 	})
 }
+function canpageolder() {
+	switch (curpagestate.name) {
+	case "atme": case "longago": case "home": case "first": case "saved":
+	case "combo": case "thread": case "hashtag": case "author": case "user":
+		return true
+	}
+	return false
+}
+function olderupdate(msg) {
+	var el = document.querySelector("#olderbox p span")
+	if (el) {
+		el.innerHTML = msg
+	}
+}
+function olderhonks(btn) {
+	btn.innerHTML = "loading"
+	btn.disabled = true
+	var args = hydrargs()
+	var stash = curpagestate.name + ":" + curpagestate.arg
+	args["older"] = bothid[stash]
+	get("/hydra?" + encode(args), function(xhr) {
+		btn.innerHTML = "older"
+		btn.disabled = false
+		if (xhr.status == 200) {
+			var lenhonks = fillinhonks(xhr, false, true)
+			olderupdate(lenhonks ? "" : " no older honks")
+		} else {
+			olderupdate(" status: " + xhr.status)
+		}
+	}, function(xhr, e) {
+		btn.innerHTML = "older"
+		btn.disabled = false
+		olderupdate(" timed out")
+	})
+}
 function statechanger(evt) {
 	var data = evt.state
 	if (!data) {
@@ -203,6 +292,12 @@ function switchtopage(name, arg) {
 
 	curpagestate.name = name
 	curpagestate.arg = arg
+	if (canpageolder()) {
+		showelement("olderbox")
+	} else {
+		hideelement("olderbox")
+	}
+	olderupdate("")
 	// get the holder for the target page
 	var stash = name + ":" + arg
 	holder = honksforpage[stash]
@@ -310,9 +405,33 @@ function showhonkform(elem, inReplyToID, hname) {
 	}
 	var updateinput = document.getElementById("updatexidinput")
 	updateinput.value = ""
+	document.getElementById("draftidinput").value = ""
 	document.getElementById("honkText").focus()
 	return false
 }
+var drafttimer, draftxhr
+function autosavedraft() {
+	clearTimeout(drafttimer)
+	drafttimer = setTimeout(savedraft, 3000)
+}
+function savedraft() {
+	// edits of posted honks aren't drafts
+	if (document.getElementById("updatexidinput").value != "")
+		return
+	var data = new FormData(lehonkform)
+	data.delete("attachment")
+	if (data.get("text").trim() == "" && !data.get("attachmentXid"))
+		return
+	var x = new XMLHttpRequest()
+	x.open("POST", "/savedraft")
+	x.timeout = 30 * 1000
+	x.onload = function() {
+		if (x.status == 200)
+			document.getElementById("draftidinput").value = x.responseText
+	}
+	x.send(data)
+	draftxhr = x
+}
 function cancelhonking() {
 	hideelement(lehonkform)
 	showelement(lehonkbutton)
@@ -330,12 +449,64 @@ function hideelement(el) {
 	el.style.display = "none"
 }
 function updateAttachment() {
-	var el = document.getElementById("attachment")
-	el.children[1].textContent = el.children[0].value.slice(-20)
+	var files = document.getElementById("attachment").children[0].files
+	attachmentname(files)
+	// one description for each file, in the same order
 	var el = document.getElementById("attachmentDescriptor")
+	el.textContent = ""
+	for (var i = 0; i < files.length; i++) {
+		var p = document.createElement("p")
+		p.pendingfile = files[i]
+		var label = document.createElement("label")
+		label.textContent = "description for " + files[i].name.slice(-20) + ":"
+		var input = document.createElement("input")
+		input.type = "text"
+		input.name = "attachmentDesc"
+		input.autocomplete = "off"
+		p.append(pendingbutton("up", -1), pendingbutton("down", 1), pendingbutton("remove", 0),
+			" ", label, document.createElement("br"), input)
+		el.append(p)
+	}
 	el.style.display = ""
-	var el = document.getElementById("saveAttachmentXid")
-	el.value = ""
+}
+function attachmentname(files) {
+	var el = document.getElementById("attachment")
+	if (files.length == 1)
+		el.children[1].textContent = files[0].name.slice(-20)
+	else if (files.length == 0)
+		el.children[1].textContent = ""
+	else
+		el.children[1].textContent = files.length + " files"
+}
+function pendingbutton(text, dir) {
+	var btn = document.createElement("button")
+	btn.type = "button"
+	btn.textContent = text
+	btn.onclick = function() {
+		if (dir == 0)
+			btn.parentElement.remove()
+		else
+			moveattachment(btn, dir)
+		reorderpending()
+	}
+	return btn
+}
+// the files are uploaded in the order of their descriptions
+function reorderpending() {
+	var dt = new DataTransfer()
+	var rows = document.getElementById("attachmentDescriptor").children
+	for (var i = 0; i < rows.length; i++)
+		dt.items.add(rows[i].pendingfile)
+	document.getElementById("attachment").children[0].files = dt.files
+	attachmentname(dt.files)
+}
+function moveattachment(btn, dir) {
+	var el = btn.parentElement
+	if (dir < 0 && el.previousElementSibling)
+		el.parentElement.insertBefore(el, el.previousElementSibling)
+	if (dir > 0 && el.nextElementSibling)
+		el.parentElement.insertBefore(el.nextElementSibling, el)
+	autosavedraft()
 }
 var checkinprec = 100.0
 var gpsoptions = {
@@ -354,6 +525,7 @@ function fillcheckin() {
 			checkinprec = 10000.0
 			gpsoptions.enableHighAccuracy = true
 			gpsoptions.timeout = 2000
+			autosavedraft()
 		}, function(err) {
 			showelement("placedescriptor")
 			el = document.getElementById("placenameinput")
@@ -21,11 +21,13 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"log"
 	notrand "math/rand"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
@@ -56,6 +58,9 @@ var honkSep = "h"
 
 var develMode = false
 
+// ++ how many files may be attached to one post
+var maxAttachments = 4
+
 func getuserstyle(u *login.UserInfo) template.CSS {
 	if u == nil {
 		return ""
@@ -95,6 +100,7 @@ func getInfo(r *http.Request) map[string]interface{} {
 		var combos []string
 		combocache.Get(u.UserID, &combos)
 		templinfo["Combos"] = combos
+		templinfo["IsAdmin"] = isadmin(u.UserID)
 	}
 	return templinfo
 }
@@ -117,35 +123,39 @@ func homepage(w http.ResponseWriter, r *http.Request) {
 		}
 	} else {
 		userid = u.UserID
+		sift := func(honks []*ActivityPubActivity, withfilt bool) []*ActivityPubActivity {
+			templinfo["BotHID"] = bottomhid(honks, 0)
+			return osmosis(honks, userid, withfilt)
+		}
 		switch r.URL.Path {
 		case "/atme":
 			templinfo["ServerMessage"] = "at me!"
 			templinfo["PageName"] = "atme"
-			honks = gethonksforme(userid, 0)
-			honks = osmosis(honks, userid, false)
+			honks = gethonksforme(userid, 0, 0)
+			honks = sift(honks, false)
 			menewnone(userid)
 		case "/longago":
 			templinfo["ServerMessage"] = "long ago and far away!"
 			templinfo["PageName"] = "longago"
-			honks = gethonksfromlongago(userid, 0)
-			honks = osmosis(honks, userid, false)
+			honks = gethonksfromlongago(userid, 0, 0)
+			honks = sift(honks, false)
 		case "/events":
 			templinfo["ServerMessage"] = "some recent and upcoming events"
 			templinfo["PageName"] = "events"
 			honks = geteventhonks(userid)
-			honks = osmosis(honks, userid, true)
+			honks = sift(honks, true)
 		case "/first":
 			templinfo["PageName"] = "first"
-			honks = gethonksforuserfirstclass(userid, 0)
-			honks = osmosis(honks, userid, true)
+			honks = gethonksforuserfirstclass(userid, 0, 0)
+			honks = sift(honks, true)
 		case "/saved":
 			templinfo["ServerMessage"] = "saved honks"
 			templinfo["PageName"] = "saved"
-			honks = getsavedhonks(userid, 0)
+			honks = getsavedhonks(userid, 0, 0)
 		default:
 			templinfo["PageName"] = "home"
-			honks = gethonksforuser(userid, 0)
-			honks = osmosis(honks, userid, true)
+			honks = gethonksforuser(userid, 0, 0)
+			honks = sift(honks, true)
 		}
 		templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
 	}
@@ -158,7 +168,7 @@ func showrss(w http.ResponseWriter, r *http.Request) {
 
 	var honks []*ActivityPubActivity
 	if name != "" {
-		honks = gethonksbyuser(name, false, 0)
+		honks = gethonksbyuser(name, false, 0, 0)
 	} else {
 		honks = getpublichonks()
 	}
@@ -315,7 +325,12 @@ func inbox(w http.ResponseWriter, r *http.Request) {
 	limiter := io.LimitReader(r.Body, 1*1024*1024)
 	io.Copy(&buf, limiter)
 	payload := buf.Bytes()
-	j, err := junk.FromBytes(payload)
+	j, err := parsejunk(payload)
+	if errors.Is(err, errNoBackend) {
+		elog.Printf("can't read inbox message: %s", err)
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		ilog.Printf("bad payload: %s", err)
 		ilog.Writer().Write(payload)
@@ -334,6 +349,10 @@ func inbox(w http.ResponseWriter, r *http.Request) {
 	}
 
 	who, _ := j.GetString("actor")
+	unlisted := policyUnlists(who)
+	if !unlisted && policyRefuses(who, "inbox") {
+		return
+	}
 	if rejectactor(user.ID, who) {
 		return
 	}
@@ -358,6 +377,9 @@ func inbox(w http.ResponseWriter, r *http.Request) {
 		ilog.Printf("keyname actor mismatch: %s <> %s", keyname, who)
 		return
 	}
+	if unlisted && policyRefuses(who, "inbox") {
+		return
+	}
 
 	switch what {
 	case "Ping":
@@ -438,7 +460,12 @@ func serverinbox(w http.ResponseWriter, r *http.Request) {
 	var buf bytes.Buffer
 	io.Copy(&buf, r.Body)
 	payload := buf.Bytes()
-	j, err := junk.FromBytes(payload)
+	j, err := parsejunk(payload)
+	if errors.Is(err, errNoBackend) {
+		elog.Printf("can't read inbox message: %s", err)
+		http.Error(w, "try again later", http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		ilog.Printf("bad payload: %s", err)
 		ilog.Writer().Write(payload)
@@ -448,6 +475,11 @@ func serverinbox(w http.ResponseWriter, r *http.Request) {
 	if crappola(j) {
 		return
 	}
+	who, _ := j.GetString("actor")
+	unlisted := policyUnlists(who)
+	if !unlisted && policyRefuses(who, "inbox") {
+		return
+	}
 	keyname, err := httpsig.VerifyRequest(r, payload, getPubKey)
 	if err != nil && keyname != "" {
 		removeOldPubkey(keyname)
@@ -463,12 +495,14 @@ func serverinbox(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "what did you call me?", http.StatusTeapot)
 		return
 	}
-	who, _ := j.GetString("actor")
 	origin := keymatch(keyname, who)
 	if origin == "" {
 		ilog.Printf("keyname actor mismatch: %s <> %s", keyname, who)
 		return
 	}
+	if unlisted && policyRefuses(who, "inbox") {
+		return
+	}
 	if rejectactor(user.ID, who) {
 		return
 	}
@@ -599,7 +633,7 @@ var oldoutbox = cache.New(cache.Options{Filler: func(name string) ([]byte, bool)
 	if err != nil {
 		return nil, false
 	}
-	honks := gethonksbyuser(name, false, 0)
+	honks := gethonksbyuser(name, false, 0, 0)
 	if len(honks) > 20 {
 		honks = honks[0:20]
 	}
@@ -705,7 +739,7 @@ func showuser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	u := login.GetUserInfo(r)
-	honks := gethonksbyuser(name, u != nil && u.Username == name, 0)
+	honks := gethonksbyuser(name, u != nil && u.Username == name, 0, 0)
 	templinfo := getInfo(r)
 	templinfo["PageName"] = "user"
 	templinfo["PageArg"] = name
@@ -722,9 +756,9 @@ func showAuthor(w http.ResponseWriter, r *http.Request) {
 	var honks []*ActivityPubActivity
 	if name == "" {
 		name = r.FormValue("xid")
-		honks = gethonksbyxonker(u.UserID, name, 0)
+		honks = gethonksbyxonker(u.UserID, name, 0, 0)
 	} else {
-		honks = getHonksByAuthor(u.UserID, name, 0)
+		honks = getHonksByAuthor(u.UserID, name, 0, 0)
 	}
 	miniform := templates.Sprintf(`<form action="/submitauthor" method="POST">
 <input type="hidden" name="CSRF" value="%s">
@@ -743,9 +777,10 @@ func showAuthor(w http.ResponseWriter, r *http.Request) {
 func showcombo(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["name"]
 	u := login.GetUserInfo(r)
-	honks := gethonksbycombo(u.UserID, name, 0)
-	honks = osmosis(honks, u.UserID, true)
+	honks := gethonksbycombo(u.UserID, name, 0, 0)
 	templinfo := getInfo(r)
+	templinfo["BotHID"] = bottomhid(honks, 0)
+	honks = osmosis(honks, u.UserID, true)
 	templinfo["PageName"] = "combo"
 	templinfo["PageArg"] = name
 	templinfo["ServerMessage"] = "honks by combo: " + name
@@ -755,27 +790,42 @@ func showcombo(w http.ResponseWriter, r *http.Request) {
 func showThread(w http.ResponseWriter, r *http.Request) {
 	c := r.FormValue("c")
 	u := login.GetUserInfo(r)
-	honks := gethonksbyThread(u.UserID, c, 0)
+	honks := gethonksbyThread(u.UserID, c, 0, 0)
 	templinfo := getInfo(r)
 	if len(honks) > 0 {
 		templinfo["TopHID"] = honks[0].ID
 	}
+	templinfo["BotHID"] = bottomhid(honks, 0)
 	honks = osmosis(honks, u.UserID, false)
 	reverseSlice(honks)
 	templinfo["PageName"] = "thread"
 	templinfo["PageArg"] = c
 	templinfo["ServerMessage"] = "honks in thread: " + c
+	if r.FormValue("view") == "tree" {
+		templinfo["Tree"] = threadtree(honks, r.FormValue("from"))
+		templinfo["ServerMessage"] = "conversation tree: " + c
+	}
 	templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
 	honkpage(w, u, honks, templinfo)
 }
 func showsearch(w http.ResponseWriter, r *http.Request) {
 	q := r.FormValue("q")
+	page, _ := strconv.Atoi(r.FormValue("page"))
+	if page < 0 {
+		page = 0
+	}
 	u := login.GetUserInfo(r)
-	honks := gethonksbysearch(u.UserID, q, 0)
+	honks := gethonksbysearch(u.UserID, q, page)
 	templinfo := getInfo(r)
 	templinfo["PageName"] = "search"
 	templinfo["PageArg"] = q
 	templinfo["ServerMessage"] = "honks for search: " + q
+	if len(honks) == searchPageSize {
+		v := url.Values{}
+		v.Set("q", q)
+		v.Set("page", strconv.Itoa(page+1))
+		templinfo["NextPageURL"] = "/search?" + v.Encode()
+	}
 	templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
 	honkpage(w, u, honks, templinfo)
 }
@@ -786,7 +836,7 @@ func showontology(w http.ResponseWriter, r *http.Request) {
 	if u != nil {
 		userid = u.UserID
 	}
-	honks := getHonksByHashtag(userid, "#"+name, 0)
+	honks := getHonksByHashtag(userid, "#"+name, 0, 0)
 	if isActivityStreamsMediaType(r.Header.Get("Accept")) {
 		if len(honks) > 40 {
 			honks = honks[0:40]
@@ -814,6 +864,8 @@ func showontology(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templinfo := getInfo(r)
+	templinfo["PageName"] = "hashtag"
+	templinfo["PageArg"] = "#" + name
 	templinfo["ServerMessage"] = "honks by ontology: " + name
 	templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
 	honkpage(w, u, honks, templinfo)
@@ -1043,7 +1095,7 @@ func showonehonk(w http.ResponseWriter, r *http.Request) {
 		honkpage(w, u, honks, templinfo)
 		return
 	}
-	rawhonks := gethonksbyThread(honk.UserID, honk.Thread, 0)
+	rawhonks := gethonksbyThread(honk.UserID, honk.Thread, 0, 0)
 	reverseSlice(rawhonks)
 	var honks []*ActivityPubActivity
 	for _, h := range rawhonks {
@@ -1070,6 +1122,9 @@ func honkpage(w http.ResponseWriter, u *login.UserInfo, honks []*ActivityPubActi
 	reverbolate(userid, honks)
 	templinfo["Honks"] = honks
 	templinfo["MapLink"] = getmaplink(u)
+	if templinfo["BotHID"] == nil {
+		templinfo["BotHID"] = bottomhid(honks, 0)
+	}
 	if templinfo["TopHID"] == nil {
 		if len(honks) > 0 {
 			templinfo["TopHID"] = honks[0].ID
@@ -1270,7 +1325,7 @@ func zonkit(w http.ResponseWriter, r *http.Request) {
 	if action == "save" {
 		xonk := getActivityPubActivity(userinfo.UserID, what)
 		if xonk != nil {
-			_, err := stmtUpdateFlags.Exec(flagIsSaved, xonk.ID)
+			err := collecthonk(userinfo.UserID, savedCollection, xonk.ID)
 			if err != nil {
 				elog.Printf("error saving: %s", err)
 			}
@@ -1281,7 +1336,7 @@ func zonkit(w http.ResponseWriter, r *http.Request) {
 	if action == "unsave" {
 		xonk := getActivityPubActivity(userinfo.UserID, what)
 		if xonk != nil {
-			_, err := stmtClearFlags.Exec(flagIsSaved, xonk.ID)
+			err := uncollecthonk(userinfo.UserID, savedCollection, xonk.ID)
 			if err != nil {
 				elog.Printf("error unsaving: %s", err)
 			}
@@ -1289,6 +1344,23 @@ func zonkit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if action == "collect" || action == "uncollect" {
+		xonk := getActivityPubActivity(userinfo.UserID, what)
+		if xonk != nil {
+			var err error
+			if action == "collect" {
+				err = collecthonk(userinfo.UserID, r.FormValue("collection"), xonk.ID)
+			} else {
+				err = uncollecthonk(userinfo.UserID, r.FormValue("collection"), xonk.ID)
+			}
+			if err != nil {
+				elog.Printf("error collecting: %s", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			}
+		}
+		return
+	}
+
 	if action == "react" {
 		reaction := user.Options.Reaction
 		if r2 := r.FormValue("reaction"); r2 != "" {
@@ -1308,6 +1380,16 @@ func zonkit(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if action == "altedit" {
+		honk := getActivityPubActivity(userinfo.UserID, what)
+		if !canedithonk(user, honk) {
+			http.Error(w, "no editing that please", http.StatusInternalServerError)
+			return
+		}
+		editalts(user, honk, r.Form["attachmentXid"], r.Form["attachmentDesc"])
+		return
+	}
+
 	// my hammer is too big, oh well
 	defer oldjonks.Flush()
 
@@ -1418,9 +1500,7 @@ func edithonkpage(w http.ResponseWriter, r *http.Request) {
 	templinfo["ServerMessage"] = "honk edit 2"
 	templinfo["IsPreview"] = true
 	templinfo["UpdateXID"] = honk.XID
-	if len(honk.Attachments) > 0 {
-		templinfo["SavedFile"] = honk.Attachments[0].XID
-	}
+	templinfo["SavedFiles"] = uploadedAttachments(honk.Attachments)
 	err := readviews.Execute(w, "honkpage.html", templinfo)
 	if err != nil {
 		elog.Print(err)
@@ -1432,15 +1512,36 @@ func newhonkpage(w http.ResponseWriter, r *http.Request) {
 	inReplyToID := r.FormValue("inReplyToID")
 	text := ""
 
-	xonk := getActivityPubActivity(u.UserID, inReplyToID)
-	if xonk != nil {
+	templinfo := getInfo(r)
+	if draftid, _ := strconv.ParseInt(r.FormValue("draft"), 10, 0); draftid != 0 {
+		d := getDraft(u.UserID, draftid)
+		if d == nil {
+			http.NotFound(w, r)
+			return
+		}
+		inReplyToID = d.InReplyToID
+		text = d.Text
+		var saved []*Attachment
+		for _, xid := range d.Attachments {
+			if a := findAttachment(fmt.Sprintf("https://%s/d/%s", serverName, xid)); a != nil {
+				saved = append(saved, a)
+			}
+		}
+		templinfo["DraftID"] = d.ID
+		templinfo["SavedFiles"] = saved
+		templinfo["SavedPlace"] = d.Place
+		if d.StartTime != "" {
+			templinfo["ShowTime"] = ";"
+			templinfo["StartTime"] = d.StartTime
+			templinfo["Duration"] = d.Duration
+		}
+	} else if xonk := getActivityPubActivity(u.UserID, inReplyToID); xonk != nil {
 		_, replto := handles(xonk.Author)
 		if replto != "" {
 			text = "@" + replto + " "
 		}
 	}
 
-	templinfo := getInfo(r)
 	templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
 	templinfo["InReplyTo"] = inReplyToID
 	templinfo["Text"] = text
@@ -1452,6 +1553,50 @@ func newhonkpage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// editalts changes the descriptions of a honk's attachments,
+// then tells everyone who got it the first time.
+func editalts(user *UserProfile, honk *ActivityPubActivity, xids, descs []string) {
+	attachmentsForHonks([]*ActivityPubActivity{honk})
+	changed := false
+	for i, xid := range xids {
+		if i >= len(descs) {
+			break
+		}
+		desc := strings.TrimSpace(descs[i])
+		for _, d := range honk.Attachments {
+			if !d.Local || d.XID != xid || desc == "" || desc == d.Desc {
+				continue
+			}
+			fileid, err := updateFileDesc(honk.ID, d.FileID, desc)
+			if err != nil {
+				elog.Printf("error updating description: %s", err)
+				continue
+			}
+			d.FileID = fileid
+			d.Desc = desc
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	oldjonks.Clear(honk.XID)
+	honk.What = "update"
+	honk.Date = time.Now().UTC()
+	go honkworldwide(user, honk)
+}
+
+// uploadedAttachments are the ones the user attached, not inline images or memes
+func uploadedAttachments(attachments []*Attachment) []*Attachment {
+	var ds []*Attachment
+	for _, d := range attachments {
+		if d.XID != "" && d.URL == fmt.Sprintf("https://%s/d/%s", serverName, d.XID) {
+			ds = append(ds, d)
+		}
+	}
+	return ds
+}
+
 func canedithonk(user *UserProfile, honk *ActivityPubActivity) bool {
 	if honk == nil || honk.Author != user.URL || honk.What == "share" {
 		return false
@@ -1460,14 +1605,52 @@ func canedithonk(user *UserProfile, honk *ActivityPubActivity) bool {
 }
 
 func submitAttachment(w http.ResponseWriter, r *http.Request) (*Attachment, error) {
+	ds, err := submitAttachments(w, r, 1)
+	if err != nil || len(ds) == 0 {
+		return nil, err
+	}
+	return ds[0], nil
+}
+
+// submitAttachments saves each uploaded attachment, in order, along with
+// the description in the same position.
+func submitAttachments(w http.ResponseWriter, r *http.Request, limit int) ([]*Attachment, error) {
 	if !strings.HasPrefix(strings.ToLower(r.Header.Get("Content-Type")), "multipart/form-data") {
 		return nil, nil
 	}
-	file, filehdr, err := r.FormFile("attachment")
+	err := r.ParseMultipartForm(32 << 20)
 	if err != nil {
-		if err == http.ErrMissingFile {
-			return nil, nil
+		elog.Printf("error reading attachment: %s", err)
+		http.Error(w, "error reading attachment", http.StatusUnsupportedMediaType)
+		return nil, err
+	}
+	filehdrs := r.MultipartForm.File["attachment"]
+	descs := r.MultipartForm.Value["attachmentDesc"]
+	if len(filehdrs) > limit {
+		ilog.Printf("too many attachments: %d", len(filehdrs))
+		http.Error(w, "too many attachments", http.StatusBadRequest)
+		return nil, errTooManyAttachments
+	}
+	var ds []*Attachment
+	for i, filehdr := range filehdrs {
+		var desc string
+		if i < len(descs) {
+			desc = descs[i]
+		}
+		d, err := saveUpload(w, filehdr, desc)
+		if err != nil {
+			return nil, err
 		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+var errTooManyAttachments = errors.New("too many attachments")
+
+func saveUpload(w http.ResponseWriter, filehdr *multipart.FileHeader, desc string) (*Attachment, error) {
+	file, err := filehdr.Open()
+	if err != nil {
 		elog.Printf("error reading attachment: %s", err)
 		http.Error(w, "error reading attachment", http.StatusUnsupportedMediaType)
 		return nil, err
@@ -1477,9 +1660,11 @@ func submitAttachment(w http.ResponseWriter, r *http.Request) (*Attachment, erro
 	file.Close()
 	data := buf.Bytes()
 	var media, name string
-	img, err := shrinkit(data)
+	var info *MediaInfo
+	img, sized, err := shrinkwithrenditions(data)
 	if err == nil {
 		data = img.Data
+		info = &MediaInfo{Width: img.Width, Height: img.Height, Blurhash: img.Blurhash}
 		format := img.Format
 		media = "image/" + format
 		if format == "jpeg" {
@@ -1487,7 +1672,24 @@ func submitAttachment(w http.ResponseWriter, r *http.Request) (*Attachment, erro
 		}
 		name = make18CharRandomString() + "." + format
 	} else {
-		ct := http.DetectContentType(data)
+		var perr error
+		info, perr = probeit(data)
+		if perr != nil {
+			elog.Printf("can't probe attachment: %s", perr)
+			http.Error(w, "attachment processing is unavailable, try again soon", http.StatusServiceUnavailable)
+			return nil, perr
+		}
+		ct := info.Media
+		if strings.HasPrefix(ct, "image/") {
+			if errors.Is(err, errNoBackend) {
+				elog.Printf("can't shrink image: %s", err)
+				http.Error(w, "image processing is unavailable, try again soon", http.StatusServiceUnavailable)
+				return nil, err
+			}
+			ilog.Printf("bad image: %s", err)
+			http.Error(w, "didn't like your image: "+err.Error(), http.StatusUnsupportedMediaType)
+			return nil, err
+		}
 		switch ct {
 		case "application/pdf":
 			maxsize := 10000000
@@ -1501,61 +1703,66 @@ func submitAttachment(w http.ResponseWriter, r *http.Request) (*Attachment, erro
 			if name == "" {
 				name = make18CharRandomString() + ".pdf"
 			}
-		case "video/mp4":
+		case "video/mp4", "video/webm", "audio/mp4", "audio/mpeg", "audio/ogg", "audio/webm":
 			maxsize := 10000000
 			if len(data) > maxsize {
-				ilog.Printf("bad video: %s too much mp4: %d", err, len(data))
-				http.Error(w, "didn't like your MP4 attachment", http.StatusUnsupportedMediaType)
+				ilog.Printf("bad media: %s too much %s: %d", err, ct, len(data))
+				http.Error(w, "didn't like your audio or video attachment", http.StatusUnsupportedMediaType)
 				return nil, err
 			}
 			media = ct
 			name = filehdr.Filename
 			if name == "" {
-				name = make18CharRandomString() + ".mp4"
+				name = make18CharRandomString() + mediaext(ct)
 			}
-		default:
+		case "text/plain":
 			maxsize := 100000
 			if len(data) > maxsize {
 				ilog.Printf("bad image: %s too much text: %d", err, len(data))
 				http.Error(w, "didn't like your text attachment", http.StatusUnsupportedMediaType)
 				return nil, err
 			}
-			for i := 0; i < len(data); i++ {
-				if data[i] < 32 && data[i] != '\t' && data[i] != '\r' && data[i] != '\n' {
-					ilog.Printf("bad image: %s not text: %d", err, data[i])
-					http.Error(w, "didn't like your text? attachment", http.StatusUnsupportedMediaType)
-					return nil, err
-				}
-			}
-			media = "text/plain"
+			media = ct
 			name = filehdr.Filename
 			if name == "" {
 				name = make18CharRandomString() + ".txt"
 			}
+		default:
+			ilog.Printf("bad attachment: %s", ct)
+			http.Error(w, "didn't like your attachment", http.StatusUnsupportedMediaType)
+			return nil, err
 		}
 	}
-	desc := strings.TrimSpace(r.FormValue("attachmentDesc"))
+	desc = strings.TrimSpace(desc)
 	if desc == "" {
 		desc = name
 	}
+	fileLock.RLock()
+	defer fileLock.RUnlock()
 	xid, err := saveFileBody(media, data)
 	if err != nil {
 		elog.Printf("unable to save image: %s", err)
 		http.Error(w, "failed to save attachment", http.StatusUnsupportedMediaType)
 		return nil, err
 	}
+	saveRenditions(xid, sized)
 	url := fmt.Sprintf("https://%s/d/%s", serverName, xid)
-	fileID, err := saveFileMetadata(xid, name, desc, url, media)
+	fileID, err := saveFileMetadata(xid, name, desc, url, media, info)
 	if err != nil {
 		elog.Printf("unable to save image: %s", err)
 		http.Error(w, "failed to save attachment", http.StatusUnsupportedMediaType)
 		return nil, err
 	}
 	d := &Attachment{
-		FileID: fileID,
-		XID:    xid,
-		Desc:   desc,
-		Local:  true,
+		FileID:   fileID,
+		XID:      xid,
+		Name:     name,
+		Desc:     desc,
+		Local:    true,
+		Blurhash: info.Blurhash,
+		Width:    info.Width,
+		Height:   info.Height,
+		Duration: info.Duration,
 	}
 	return d, nil
 }
@@ -1665,18 +1872,12 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 	honk.Public = publicAudience(honk.Audience)
 	honk.Thread = thread
 
-	attachmentXid := r.FormValue("attachmentXid")
-	if attachmentXid == "" {
-		d, err := submitAttachment(w, r)
-		if err != nil && err != http.ErrMissingFile {
-			return nil
-		}
-		if d != nil {
-			honk.Attachments = append(honk.Attachments, d)
-			attachmentXid = d.XID
+	// saved attachments keep the order given, new uploads go after
+	r.ParseMultipartForm(32 << 20)
+	for _, xid := range r.Form["attachmentXid"] {
+		if xid == "" {
+			continue
 		}
-	} else {
-		xid := attachmentXid
 		url := fmt.Sprintf("https://%s/d/%s", serverName, xid)
 		attachment := findAttachment(url)
 		if attachment != nil {
@@ -1685,19 +1886,20 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 			ilog.Printf("can't find file: %s", xid)
 		}
 	}
+	if len(honk.Attachments) > maxAttachments {
+		http.Error(w, "too many attachments", http.StatusBadRequest)
+		return nil
+	}
+	ds, err := submitAttachments(w, r, maxAttachments-len(honk.Attachments))
+	if err != nil {
+		return nil
+	}
+	honk.Attachments = append(honk.Attachments, ds...)
+	savedfiles := uploadedAttachments(honk.Attachments)
 	memetize(honk)
 	imaginate(honk)
 
-	placename := strings.TrimSpace(r.FormValue("placename"))
-	placelat := strings.TrimSpace(r.FormValue("placelat"))
-	placelong := strings.TrimSpace(r.FormValue("placelong"))
-	placeurl := strings.TrimSpace(r.FormValue("placeurl"))
-	if placename != "" || placelat != "" || placelong != "" || placeurl != "" {
-		p := new(Place)
-		p.Name = placename
-		p.Latitude, _ = strconv.ParseFloat(placelat, 64)
-		p.Longitude, _ = strconv.ParseFloat(placelong, 64)
-		p.Url = placeurl
+	if p := placefromform(r); p != nil {
 		honk.Place = p
 	}
 	timestart := strings.TrimSpace(r.FormValue("timestart"))
@@ -1743,7 +1945,7 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 		templinfo["MapLink"] = getmaplink(userinfo)
 		templinfo["InReplyTo"] = r.FormValue("inReplyToID")
 		templinfo["Text"] = r.FormValue("text")
-		templinfo["SavedFile"] = attachmentXid
+		templinfo["SavedFiles"] = savedfiles
 		if tm := honk.Time; tm != nil {
 			templinfo["ShowTime"] = ";"
 			templinfo["StartTime"] = tm.StartTime.Format("2006-01-02 15:04")
@@ -1753,6 +1955,7 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 		}
 		templinfo["IsPreview"] = true
 		templinfo["UpdateXID"] = updatexid
+		templinfo["DraftID"] = r.FormValue("draftid")
 		templinfo["ServerMessage"] = "honk preview"
 		err := readviews.Execute(w, "honkpage.html", templinfo)
 		if err != nil {
@@ -1771,6 +1974,12 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 			return nil
 		}
 	}
+	if draftid, _ := strconv.ParseInt(r.FormValue("draftid"), 10, 0); draftid != 0 {
+		err := deleteDraft(userinfo.UserID, draftid)
+		if err != nil {
+			elog.Printf("error deleting draft: %s", err)
+		}
+	}
 
 	// reload for consistency
 	honk.Attachments = nil
@@ -1781,6 +1990,168 @@ func submithonk(w http.ResponseWriter, r *http.Request) *ActivityPubActivity {
 	return honk
 }
 
+// placefromform reads the location fields of the honk form
+func placefromform(r *http.Request) *Place {
+	placename := strings.TrimSpace(r.FormValue("placename"))
+	placelat := strings.TrimSpace(r.FormValue("placelat"))
+	placelong := strings.TrimSpace(r.FormValue("placelong"))
+	placeurl := strings.TrimSpace(r.FormValue("placeurl"))
+	if placename == "" && placelat == "" && placelong == "" && placeurl == "" {
+		return nil
+	}
+	p := new(Place)
+	p.Name = placename
+	p.Latitude, _ = strconv.ParseFloat(placelat, 64)
+	p.Longitude, _ = strconv.ParseFloat(placelong, 64)
+	p.Url = placeurl
+	return p
+}
+
+func savedraft(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	r.ParseMultipartForm(32 << 20)
+	text := strings.Replace(r.FormValue("text"), "\r", "", -1)
+	d := &Draft{
+		UserID:      u.UserID,
+		Date:        time.Now().UTC(),
+		Text:        text,
+		Precis:      draftprecis(text),
+		InReplyToID: r.FormValue("inReplyToID"),
+		Place:       placefromform(r),
+		StartTime:   strings.TrimSpace(r.FormValue("timestart")),
+		Duration:    strings.TrimSpace(r.FormValue("timeend")),
+	}
+	d.ID, _ = strconv.ParseInt(r.FormValue("draftid"), 10, 0)
+	for _, xid := range r.Form["attachmentXid"] {
+		if xid != "" {
+			d.Attachments = append(d.Attachments, xid)
+		}
+	}
+	if strings.TrimSpace(d.Text) == "" && len(d.Attachments) == 0 {
+		http.Error(w, "nothing to save", http.StatusBadRequest)
+		return
+	}
+	err := saveDraft(d)
+	if errors.Is(err, errDraftGone) {
+		http.Error(w, "draft is gone", http.StatusGone)
+		return
+	}
+	if err != nil {
+		elog.Printf("error saving draft: %s", err)
+		http.Error(w, "error saving draft", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "%d", d.ID)
+}
+
+func draftspage(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	templinfo := getInfo(r)
+	templinfo["Drafts"] = getDrafts(u.UserID)
+	templinfo["DraftCSRF"] = login.GetCSRF("honkhonk", r)
+	err := readviews.Execute(w, "drafts.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
+func zapdraft(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	draftid, _ := strconv.ParseInt(r.FormValue("draftid"), 10, 0)
+	err := deleteDraft(u.UserID, draftid)
+	if err != nil {
+		elog.Printf("error deleting draft: %s", err)
+	}
+	http.Redirect(w, r, "/drafts", http.StatusSeeOther)
+}
+
+func collectionspage(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	templinfo := getInfo(r)
+	templinfo["Collections"] = getCollections(u.UserID)
+	templinfo["CollectionCSRF"] = login.GetCSRF("collection", r)
+	err := readviews.Execute(w, "collections.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
+func showcollection(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	name := r.FormValue("name")
+	c := getCollection(u.UserID, name)
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+	honks := gethonksbycollection(u.UserID, c.ID)
+	switch r.FormValue("format") {
+	case "md":
+		w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+		io.WriteString(w, collectionmarkdown(c, honks))
+		return
+	case "json":
+		reverbolate(u.UserID, honks)
+		w.Header().Set("Content-Type", "application/json")
+		must.OK(json.NewEncoder(w).Encode(tj.O{
+			"name":  c.Name,
+			"notes": c.Notes,
+			"honks": honks,
+		}))
+		return
+	}
+	export := "/collection?" + url.Values{"name": {c.Name}}.Encode()
+	templinfo := getInfo(r)
+	templinfo["PageName"] = "collection"
+	templinfo["PageArg"] = c.Name
+	templinfo["Collection"] = c.Name
+	msg := templates.Sprintf("collection: %s", c.Name)
+	if c.Notes != "" {
+		msg += templates.Sprintf("<p>%s", c.Notes)
+	}
+	msg += templates.Sprintf(`<p>export: <a href="%s&format=md">markdown</a> <a href="%s&format=json">json</a>`, export, export)
+	templinfo["ServerMessage"] = msg
+	templinfo["HonkCSRF"] = login.GetCSRF("honkhonk", r)
+	honkpage(w, u, honks, templinfo)
+}
+
+func savecollection(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	c := &Collection{UserID: u.UserID, Name: r.FormValue("name"), Notes: r.FormValue("notes")}
+	c.ID, _ = strconv.ParseInt(r.FormValue("collectionid"), 10, 0)
+	c.Notes = strings.Replace(c.Notes, "\r", "", -1)
+	var err error
+	if r.FormValue("delete") != "" {
+		err = deleteCollection(u.UserID, c.ID)
+	} else {
+		err = saveCollection(c)
+	}
+	if err != nil {
+		elog.Printf("error saving collection: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/collections", http.StatusSeeOther)
+}
+
+func historypage(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	xid := r.FormValue("xid")
+	honk := getActivityPubActivity(u.UserID, xid)
+	if honk == nil {
+		http.NotFound(w, r)
+		return
+	}
+	attachmentsForHonks([]*ActivityPubActivity{honk})
+	templinfo := getInfo(r)
+	templinfo["Honk"] = honk
+	templinfo["Revisions"] = honkrevisions(honk)
+	err := readviews.Execute(w, "history.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
 func showAuthors(w http.ResponseWriter, r *http.Request) {
 	userinfo := login.GetUserInfo(r)
 	templinfo := getInfo(r)
@@ -1837,7 +2208,7 @@ func submitChatMessage(w http.ResponseWriter, r *http.Request) {
 		Format: format,
 	}
 	d, err := submitAttachment(w, r)
-	if err != nil && err != http.ErrMissingFile {
+	if err != nil {
 		return
 	}
 	if d != nil {
@@ -1951,27 +2322,16 @@ func hfcspage(w http.ResponseWriter, r *http.Request) {
 
 	templinfo := getInfo(r)
 	templinfo["Filters"] = filters
+	templinfo["Publishers"] = getfilterpublishers(userinfo.UserID)
 	templinfo["FilterCSRF"] = login.GetCSRF("filter", r)
+	templinfo["TrialMax"] = maxTrialCount
 	err := readviews.Execute(w, "hfcs.html", templinfo)
 	if err != nil {
 		elog.Print(err)
 	}
 }
 
-func savehfcs(w http.ResponseWriter, r *http.Request) {
-	userinfo := login.GetUserInfo(r)
-	itsok := r.FormValue("itsok")
-	if itsok == "iforgiveyou" {
-		hfcsid, _ := strconv.ParseInt(r.FormValue("hfcsid"), 10, 0)
-		_, err := stmtDeleteFilter.Exec(userinfo.UserID, hfcsid)
-		if err != nil {
-			elog.Printf("error deleting filter: %s", err)
-		}
-		filtInvalidator.Clear(userinfo.UserID)
-		http.Redirect(w, r, "/hfcs", http.StatusSeeOther)
-		return
-	}
-
+func filterfromform(r *http.Request) (*Filter, error) {
 	filt := new(Filter)
 	filt.Name = strings.TrimSpace(r.FormValue("name"))
 	filt.Date = time.Now().UTC()
@@ -1980,6 +2340,26 @@ func savehfcs(w http.ResponseWriter, r *http.Request) {
 	filt.Text = strings.TrimSpace(r.FormValue("filttext"))
 	filt.IsAnnounce = r.FormValue("isannounce") == "yes"
 	filt.AnnounceOf = strings.TrimSpace(r.FormValue("announceof"))
+	filt.Hashtag = strings.TrimSpace(r.FormValue("filthashtag"))
+	if filt.Hashtag != "" && filt.Hashtag[0] != '#' {
+		filt.Hashtag = "#" + filt.Hashtag
+	}
+	filt.Media = strings.ToLower(strings.TrimSpace(r.FormValue("filtmedia")))
+	filt.Lang = strings.ToLower(strings.TrimSpace(r.FormValue("filtlang")))
+	if n, err := strconv.Atoi(r.FormValue("filtmentions")); err == nil && n >= 0 {
+		filt.MinMentions = n + 1
+	}
+	switch r.FormValue("replymode") {
+	case "reply":
+		filt.IsReply = true
+	case "toplevel":
+		filt.IsTopLevel = true
+	}
+	cond, err := parseFiltCond(r.FormValue("filtcond"))
+	if err != nil {
+		return nil, fmt.Errorf("can't understand condition: %s", err)
+	}
+	filt.Cond = cond
 	filt.Reject = r.FormValue("doreject") == "yes"
 	filt.SkipMedia = r.FormValue("doskipmedia") == "yes"
 	filt.Hide = r.FormValue("dohide") == "yes"
@@ -1990,8 +2370,100 @@ func savehfcs(w http.ResponseWriter, r *http.Request) {
 		filt.Expiration = time.Now().UTC().Add(dur)
 	}
 	filt.Notes = strings.TrimSpace(r.FormValue("filtnotes"))
+	filt.Shared = r.FormValue("shared") == "yes"
+	return filt, nil
+}
+
+// gethonksforuser only goes back this far
+const maxTrialCount = 250
+
+// hfcstrial shows what a filter would do to recent honks, without saving it
+func hfcstrial(w http.ResponseWriter, r *http.Request, filt *Filter) {
+	userinfo := login.GetUserInfo(r)
+	err := filt.compile()
+	if err != nil {
+		http.Error(w, "can't compile filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	count, _ := strconv.Atoi(r.FormValue("trialcount"))
+	if count <= 0 {
+		count = 100
+	}
+	if count > maxTrialCount {
+		count = maxTrialCount
+	}
+	honks := gethonksforuser(userinfo.UserID, 0, 0)
+	if len(honks) > count {
+		honks = honks[:count]
+	}
+
+	templinfo := getInfo(r)
+	templinfo["Filters"] = getfilters(userinfo.UserID, filtAny)
+	templinfo["Publishers"] = getfilterpublishers(userinfo.UserID)
+	templinfo["FilterCSRF"] = login.GetCSRF("filter", r)
+	templinfo["TrialMax"] = maxTrialCount
+	templinfo["Draft"] = filt
+	templinfo["DraftCond"] = filt.Cond.String()
+	templinfo["DraftDuration"] = r.FormValue("filtduration")
+	if filt.MinMentions > 0 {
+		templinfo["DraftMentions"] = filt.MinMentions - 1
+	}
+	templinfo["Trials"] = tryfilter(filt, honks)
+	templinfo["TrialCount"] = count
+	templinfo["TrialTested"] = len(honks)
+	err = readviews.Execute(w, "hfcs.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
+func savehfcs(w http.ResponseWriter, r *http.Request) {
+	userinfo := login.GetUserInfo(r)
+	itsok := r.FormValue("itsok")
+	if itsok == "iforgiveyou" {
+		hfcsid, _ := strconv.ParseInt(r.FormValue("hfcsid"), 10, 0)
+		res, err := stmtDeleteFilter.Exec(userinfo.UserID, hfcsid)
+		if err != nil {
+			elog.Printf("error deleting filter: %s", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			forgetfiltstats(hfcsid)
+		}
+		filtersChanged(userinfo.UserID)
+		http.Redirect(w, r, "/hfcs", http.StatusSeeOther)
+		return
+	}
+	if owner, _ := strconv.ParseInt(r.FormValue("subscribe"), 10, 0); owner != 0 {
+		var err error
+		if r.FormValue("unsubscribe") == "yes" {
+			_, err = stmtDeleteFilterSub.Exec(userinfo.UserID, owner)
+		} else if owner == userinfo.UserID || !sharesfilters(owner) {
+			http.Error(w, "no filters shared by that user", http.StatusBadRequest)
+			return
+		} else {
+			_, err = stmtDeleteFilterSub.Exec(userinfo.UserID, owner)
+			if err == nil {
+				_, err = stmtSaveFilterSub.Exec(userinfo.UserID, owner)
+			}
+		}
+		if err != nil {
+			elog.Printf("error saving filter subscription: %s", err)
+		}
+		filtInvalidator.Clear(userinfo.UserID)
+		http.Redirect(w, r, "/hfcs", http.StatusSeeOther)
+		return
+	}
+
+	filt, err := filterfromform(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("dryrun") != "" {
+		hfcstrial(w, r, filt)
+		return
+	}
 
-	if filt.Actor == "" && filt.Text == "" && !filt.IsAnnounce {
+	if filt.Actor == "" && filt.Text == "" && !filt.IsAnnounce && !filt.hasExtras() {
 		ilog.Printf("blank filter")
 		http.Error(w, "can't save a blank filter", http.StatusInternalServerError)
 		return
@@ -2005,10 +2477,105 @@ func savehfcs(w http.ResponseWriter, r *http.Request) {
 		elog.Printf("error saving filter: %s", err)
 	}
 
-	filtInvalidator.Clear(userinfo.UserID)
+	filtersChanged(userinfo.UserID)
 	http.Redirect(w, r, "/hfcs", http.StatusSeeOther)
 }
 
+func exporthfcs(w http.ResponseWriter, r *http.Request) {
+	userinfo := login.GetUserInfo(r)
+	filters := []*Filter{}
+	for _, f := range getfilters(userinfo.UserID, filtAny) {
+		if f.Owner == "" {
+			filters = append(filters, f)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="honk-filters.json"`)
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	err := e.Encode(filters)
+	if err != nil {
+		elog.Printf("error exporting filters: %s", err)
+	}
+}
+
+func importhfcs(w http.ResponseWriter, r *http.Request) {
+	userinfo := login.GetUserInfo(r)
+	file, _, err := r.FormFile("filtfile")
+	if err != nil {
+		http.Error(w, "no file to import", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	var buf bytes.Buffer
+	limiter := io.LimitReader(file, 4*1024*1024)
+	_, err = io.Copy(&buf, limiter)
+	if err != nil {
+		elog.Printf("error reading filter import: %s", err)
+		http.Error(w, "error reading file", http.StatusInternalServerError)
+		return
+	}
+	added, dups, err := importfilters(userinfo.UserID, buf.Bytes())
+	if err != nil {
+		ilog.Printf("error importing filters: %s", err)
+		http.Error(w, "can't import that: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	templinfo := getInfo(r)
+	templinfo["ServerMessage"] = fmt.Sprintf("Imported %d filters, skipped %d duplicates.", added, dups)
+	err = readviews.Execute(w, "msg.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
+func refusalspage(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	if !isadmin(u.UserID) {
+		http.NotFound(w, r)
+		return
+	}
+	var allowed []*DomainPolicy
+	for _, p := range getDomainPolicies() {
+		if p.Actions&policyAllow != 0 {
+			allowed = append(allowed, p)
+		}
+	}
+	templinfo := getInfo(r)
+	templinfo["AllowlistMode"] = allowlistMode
+	templinfo["Refused"] = getRefusedHosts()
+	templinfo["Allowed"] = allowed
+	templinfo["RefusalsCSRF"] = login.GetCSRF("refusals", r)
+	err := readviews.Execute(w, "refusals.html", templinfo)
+	if err != nil {
+		elog.Print(err)
+	}
+}
+
+func saverefusals(w http.ResponseWriter, r *http.Request) {
+	u := login.GetUserInfo(r)
+	if !isadmin(u.UserID) {
+		http.NotFound(w, r)
+		return
+	}
+	host := strings.TrimSpace(r.FormValue("host"))
+	switch r.FormValue("action") {
+	case "allow":
+		err := allowhost(host)
+		if err != nil {
+			elog.Printf("error allowing %s: %s", host, err)
+		} else {
+			ilog.Printf("%s added %s to allowlist", u.Username, host)
+		}
+	case "forget":
+		_, err := stmtDeleteRefusal.Exec(host)
+		if err != nil {
+			elog.Printf("error forgetting refusal: %s", err)
+		}
+	}
+	http.Redirect(w, r, "/refusals", http.StatusSeeOther)
+}
+
 func accountpage(w http.ResponseWriter, r *http.Request) {
 	u := login.GetUserInfo(r)
 	user, _ := getUserBio(u.Username)
@@ -2075,6 +2642,19 @@ func webfinger(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	// most servers don't sign webfinger, and it tells nothing the
+	// actor doesn't, but a signature from an unlisted host is refused.
+	if allowlistMode && r.Header.Get("Signature") != "" {
+		keyname, err := httpsig.VerifyRequest(r, nil, getPubKey)
+		if err != nil && keyname != "" {
+			removeOldPubkey(keyname)
+			keyname, err = httpsig.VerifyRequest(r, nil, getPubKey)
+		}
+		if err == nil && policyRefuses(keyname, "webfinger") {
+			http.NotFound(w, r)
+			return
+		}
+	}
 
 	j := tj.O{
 		"subject": fmt.Sprintf("acct:%s@%s", user.Name, masqName),
@@ -2207,18 +2787,25 @@ func servememe(w http.ResponseWriter, r *http.Request) {
 func servefile(w http.ResponseWriter, r *http.Request) {
 	xid := mux.Vars(r)["xid"]
 	var media string
-	var data []byte
-	row := stmtGetFileData.QueryRow(xid)
-	err := row.Scan(&media, &data)
+	var rd io.ReadSeekCloser
+	var err error
+	if size := r.FormValue("size"); size != "" {
+		// not every image has smaller copies, so fall back to the original
+		media, rd, err = mediaStore.Open(sizedxid(xid, size))
+	}
+	if rd == nil {
+		media, rd, err = mediaStore.Open(xid)
+	}
 	if err != nil {
 		elog.Printf("error loading file: %s", err)
 		http.NotFound(w, r)
 		return
 	}
+	defer rd.Close()
 	w.Header().Set("Content-Type", media)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.Header().Set("Cache-Control", "max-age="+somedays())
-	w.Write(data)
+	http.ServeContent(w, r, "", time.Time{}, rd)
 }
 
 func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
@@ -2227,6 +2814,7 @@ func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "Allow: /fp/\n")
 	io.WriteString(w, "Disallow: /a\n")
 	io.WriteString(w, "Disallow: /d/\n")
+	io.WriteString(w, "Disallow: /proxy/\n")
 	io.WriteString(w, "Disallow: /meme/\n")
 	io.WriteString(w, "Disallow: /o\n")
 	io.WriteString(w, "Disallow: /o/\n")
@@ -2238,12 +2826,24 @@ func robotsTxtHandler(w http.ResponseWriter, r *http.Request) {
 
 type Hydration struct {
 	Tophid    int64
+	Bothid    int64
 	Srvmsg    template.HTML
 	Honks     string
 	MeCount   int64
 	ChatCount int64
 }
 
+// bottomhid is the cursor for the next older page
+func bottomhid(honks []*ActivityPubActivity, older int64) int64 {
+	hid := older
+	for _, h := range honks {
+		if hid == 0 || h.ID < hid {
+			hid = h.ID
+		}
+	}
+	return hid
+}
+
 func webhydra(w http.ResponseWriter, r *http.Request) {
 	u := login.GetUserInfo(r)
 	userid := u.UserID
@@ -2252,45 +2852,52 @@ func webhydra(w http.ResponseWriter, r *http.Request) {
 	page := r.FormValue("page")
 
 	wanted, _ := strconv.ParseInt(r.FormValue("tophid"), 10, 0)
+	older, _ := strconv.ParseInt(r.FormValue("older"), 10, 0)
 
 	var hydra Hydration
 
 	var honks []*ActivityPubActivity
+	// the cursor comes from what was read, not what survived filtering
+	var bot int64
+	sift := func(honks []*ActivityPubActivity, withfilt bool) []*ActivityPubActivity {
+		bot = bottomhid(honks, older)
+		return osmosis(honks, userid, withfilt)
+	}
 	switch page {
 	case "atme":
-		honks = gethonksforme(userid, wanted)
-		honks = osmosis(honks, userid, false)
+		honks = gethonksforme(userid, wanted, older)
+		honks = sift(honks, false)
 		menewnone(userid)
 		hydra.Srvmsg = "at me!"
 	case "longago":
-		honks = gethonksfromlongago(userid, wanted)
-		honks = osmosis(honks, userid, false)
+		honks = gethonksfromlongago(userid, wanted, older)
+		honks = sift(honks, false)
 		hydra.Srvmsg = "from long ago"
 	case "home":
-		honks = gethonksforuser(userid, wanted)
-		honks = osmosis(honks, userid, true)
+		honks = gethonksforuser(userid, wanted, older)
+		honks = sift(honks, true)
 		hydra.Srvmsg = serverMsg
 	case "first":
-		honks = gethonksforuserfirstclass(userid, wanted)
-		honks = osmosis(honks, userid, true)
+		honks = gethonksforuserfirstclass(userid, wanted, older)
+		honks = sift(honks, true)
 		hydra.Srvmsg = "first class only"
 	case "saved":
-		honks = getsavedhonks(userid, wanted)
+		honks = getsavedhonks(userid, wanted, older)
 		templinfo["PageName"] = "saved"
 		hydra.Srvmsg = "saved honks"
 	case "combo":
 		c := r.FormValue("c")
-		honks = gethonksbycombo(userid, c, wanted)
-		honks = osmosis(honks, userid, false)
+		honks = gethonksbycombo(userid, c, wanted, older)
+		honks = sift(honks, true)
 		hydra.Srvmsg = templates.Sprintf("honks by combo: %s", c)
 	case "thread":
 		c := r.FormValue("c")
-		honks = gethonksbyThread(userid, c, wanted)
-		honks = osmosis(honks, userid, false)
+		honks = gethonksbyThread(userid, c, wanted, older)
+		honks = sift(honks, false)
 		hydra.Srvmsg = templates.Sprintf("honks in thread: %s", c)
 	case "author":
 		xid := r.FormValue("xid")
-		honks = gethonksbyxonker(userid, xid, wanted)
+		honks = gethonksbyxonker(userid, xid, wanted, older)
 		miniform := templates.Sprintf(`<form action="/submitauthor" method="POST">
 			<input type="hidden" name="CSRF" value="%s">
 			<input type="hidden" name="url" value="%s">
@@ -2298,19 +2905,28 @@ func webhydra(w http.ResponseWriter, r *http.Request) {
 			</form>`, login.GetCSRF("submitauthor", r), xid)
 		msg := templates.Sprintf(`honks by author: <a href="%s" ref="noreferrer">%s</a>%s`, xid, xid, miniform)
 		hydra.Srvmsg = msg
+	case "hashtag":
+		c := r.FormValue("c")
+		honks = getHonksByHashtag(userid, c, wanted, older)
+		honks = sift(honks, false)
+		hydra.Srvmsg = templates.Sprintf("honks by ontology: %s", c)
 	case "user":
 		uname := r.FormValue("uname")
-		honks = gethonksbyuser(uname, u != nil && u.Username == uname, wanted)
+		honks = gethonksbyuser(uname, u != nil && u.Username == uname, wanted, older)
 		hydra.Srvmsg = templates.Sprintf("honks by user: %s", uname)
 	default:
 		http.NotFound(w, r)
 	}
 
-	if len(honks) > 0 {
+	if len(honks) > 0 && older == 0 {
 		hydra.Tophid = honks[0].ID
 	} else {
 		hydra.Tophid = wanted
 	}
+	if bot == 0 {
+		bot = bottomhid(honks, older)
+	}
+	hydra.Bothid = bot
 	reverbolate(userid, honks)
 
 	user, _ := getUserBio(u.Username)
@@ -2370,28 +2986,68 @@ func apihandler(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(d.XID))
 	case "zonkit":
 		zonkit(w, r)
+	case "altedit", "collect", "uncollect":
+		zonkit(w, r)
+	case "getcollections":
+		w.Header().Set("Content-Type", "application/json")
+		must.OK(json.NewEncoder(w).Encode(tj.O{
+			"collections": getCollections(userid),
+		}))
+	case "gettree":
+		honks := gethonksbyThread(userid, r.FormValue("c"), 0, 0)
+		honks = osmosis(honks, userid, false)
+		reverseSlice(honks)
+		reverbolate(userid, honks)
+		must.OK(json.NewEncoder(w).Encode(tj.O{
+			"tree": threadtree(honks, r.FormValue("from")),
+		}))
 	case "gethonks":
 		var honks []*ActivityPubActivity
 		wanted, _ := strconv.ParseInt(r.FormValue("after"), 10, 0)
+		older, _ := strconv.ParseInt(r.FormValue("before"), 10, 0)
 		page := r.FormValue("page")
 		var waitchan <-chan time.Time
+		var bot int64
+		sift := func(honks []*ActivityPubActivity, withfilt bool) []*ActivityPubActivity {
+			bot = bottomhid(honks, older)
+			return osmosis(honks, userid, withfilt)
+		}
 	requery:
 		switch page {
 		case "atme":
-			honks = gethonksforme(userid, wanted)
-			honks = osmosis(honks, userid, false)
+			honks = gethonksforme(userid, wanted, older)
+			honks = sift(honks, false)
 			menewnone(userid)
 		case "longago":
-			honks = gethonksfromlongago(userid, wanted)
-			honks = osmosis(honks, userid, false)
+			honks = gethonksfromlongago(userid, wanted, older)
+			honks = sift(honks, false)
 		case "home":
-			honks = gethonksforuser(userid, wanted)
-			honks = osmosis(honks, userid, true)
+			honks = gethonksforuser(userid, wanted, older)
+			honks = sift(honks, true)
+		case "first":
+			honks = gethonksforuserfirstclass(userid, wanted, older)
+			honks = sift(honks, true)
+		case "saved":
+			honks = getsavedhonks(userid, wanted, older)
+		case "combo":
+			honks = gethonksbycombo(userid, r.FormValue("c"), wanted, older)
+			honks = sift(honks, true)
+		case "thread":
+			honks = gethonksbyThread(userid, r.FormValue("c"), wanted, older)
+			honks = sift(honks, false)
+		case "hashtag":
+			honks = getHonksByHashtag(userid, r.FormValue("c"), wanted, older)
+			honks = sift(honks, false)
+		case "author":
+			honks = gethonksbyxonker(userid, r.FormValue("xid"), wanted, older)
+		case "user":
+			uname := r.FormValue("uname")
+			honks = gethonksbyuser(uname, u.Username == uname, wanted, older)
 		default:
 			http.Error(w, "unknown page", http.StatusNotFound)
 			return
 		}
-		if len(honks) == 0 && wait > 0 {
+		if len(honks) == 0 && wait > 0 && older == 0 {
 			if waitchan == nil {
 				waitchan = time.After(time.Duration(wait) * time.Second)
 			}
@@ -2401,9 +3057,13 @@ func apihandler(w http.ResponseWriter, r *http.Request) {
 			case <-waitchan:
 			}
 		}
+		if bot == 0 {
+			bot = bottomhid(honks, older)
+		}
 		reverbolate(userid, honks)
 		must.OK(json.NewEncoder(w).Encode(tj.O{
-			"honks": honks,
+			"honks":  honks,
+			"before": bot,
 		}))
 	case "sendactivity":
 		user, _ := getUserBio(u.Username)
@@ -2435,6 +3095,7 @@ func exitSignalHandler() {
 	for i := 0; i < workinprogress; i++ {
 		<-readyalready
 	}
+	flushfiltstats()
 	ilog.Printf("apocalypse")
 	os.Exit(0)
 }
@@ -2491,6 +3152,9 @@ func serve() {
 	go redeliveryLoop()
 	go tracker()
 	go bgmonitor()
+	go filtstatsflusher()
+	go buildsearchindex()
+	go retentionloop()
 	loadLingo()
 	extractViewsToTmpDir()
 
@@ -2503,6 +3167,7 @@ func serve() {
 		viewDir+"/views/combos.html",
 		viewDir+"/views/honkform.html",
 		viewDir+"/views/honk.html",
+		viewDir+"/views/threadnode.html",
 		viewDir+"/views/account.html",
 		viewDir+"/views/about.html",
 		viewDir+"/views/login.html",
@@ -2510,6 +3175,10 @@ func serve() {
 		viewDir+"/views/msg.html",
 		viewDir+"/views/header.html",
 		viewDir+"/views/hashtags.html",
+		viewDir+"/views/refusals.html",
+		viewDir+"/views/drafts.html",
+		viewDir+"/views/history.html",
+		viewDir+"/views/collections.html",
 		viewDir+"/views/honkpage.js",
 	)
 	if !develMode {
@@ -2587,12 +3256,24 @@ func serve() {
 	LoggedInRouter.HandleFunc("/longago", homepage)
 	LoggedInRouter.HandleFunc("/hfcs", hfcspage)
 	LoggedInRouter.HandleFunc("/xzone", xzone)
+	LoggedInRouter.HandleFunc("/refusals", refusalspage)
+	LoggedInRouter.Handle("/saverefusals", login.CSRFWrap("refusals", http.HandlerFunc(saverefusals)))
 	LoggedInRouter.HandleFunc("/newhonk", newhonkpage)
 	LoggedInRouter.HandleFunc("/edit", edithonkpage)
+	LoggedInRouter.HandleFunc("/drafts", draftspage)
+	LoggedInRouter.HandleFunc("/history", historypage)
+	LoggedInRouter.HandleFunc("/proxy/{fileid:[[:digit:]]+}", serveproxy)
+	LoggedInRouter.HandleFunc("/collections", collectionspage)
+	LoggedInRouter.HandleFunc("/collection", showcollection)
+	LoggedInRouter.Handle("/savecollection", login.CSRFWrap("collection", http.HandlerFunc(savecollection)))
+	LoggedInRouter.Handle("/savedraft", login.CSRFWrap("honkhonk", http.HandlerFunc(savedraft)))
+	LoggedInRouter.Handle("/deletedraft", login.CSRFWrap("honkhonk", http.HandlerFunc(zapdraft)))
 	LoggedInRouter.Handle("/honk", login.CSRFWrap("honkhonk", http.HandlerFunc(submitwebhonk)))
 	LoggedInRouter.Handle("/share", login.CSRFWrap("honkhonk", http.HandlerFunc(submitShare)))
 	LoggedInRouter.Handle("/zonkit", login.CSRFWrap("honkhonk", http.HandlerFunc(zonkit)))
 	LoggedInRouter.Handle("/savehfcs", login.CSRFWrap("filter", http.HandlerFunc(savehfcs)))
+	LoggedInRouter.HandleFunc("/exporthfcs", exporthfcs)
+	LoggedInRouter.Handle("/importhfcs", login.CSRFWrap("filter", http.HandlerFunc(importhfcs)))
 	LoggedInRouter.Handle("/saveuser", login.CSRFWrap("saveuser", http.HandlerFunc(saveuser)))
 	LoggedInRouter.Handle("/ximport", login.CSRFWrap("ximport", http.HandlerFunc(ximport)))
 	LoggedInRouter.HandleFunc("/authors", showAuthors)